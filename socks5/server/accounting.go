@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Usage 按客户端与目的地址汇总的流量,
+// BytesIn 为从客户端收到的字节数, BytesOut 为发往客户端的字节数
+type Usage struct {
+	Client    string        `json:"client"`
+	Dest      string        `json:"dest"`
+	Streams   uint64        `json:"streams"`
+	BytesIn   uint64        `json:"bytes_in"`
+	BytesOut  uint64        `json:"bytes_out"`
+	Duration  time.Duration `json:"duration"`
+	FirstSeen time.Time     `json:"first_seen"`
+	LastSeen  time.Time     `json:"last_seen"`
+}
+
+type usageKey struct {
+	client, dest string
+}
+
+type usageEntry struct {
+	Usage
+	bytesIn, bytesOut atomic.Uint64
+}
+
+// Accounting 统计每次转发的流量与时长, 定期写入本地文件
+type Accounting struct {
+	mu    sync.Mutex
+	path  string
+	usage map[usageKey]*usageEntry
+}
+
+var _accounting = &Accounting{usage: make(map[usageKey]*usageEntry)}
+
+// relayAccount 单次转发的计数器
+type relayAccount struct {
+	client, dest      string
+	start             time.Time
+	entry             *usageEntry
+	bytesIn, bytesOut atomic.Uint64
+}
+
+// load 从 path 加载历史汇总, 之后的 flush 写回同一文件
+func (a *Accounting) load(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.path = path
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var usage []Usage
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return err
+	}
+	for _, u := range usage {
+		a.usage[usageKey{u.Client, u.Dest}] = &usageEntry{Usage: u}
+	}
+	return nil
+}
+
+func (a *Accounting) open(client, dest string) *relayAccount {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := usageKey{client, dest}
+	entry, ok := a.usage[key]
+	if !ok {
+		entry = &usageEntry{Usage: Usage{Client: client, Dest: dest, FirstSeen: now}}
+		a.usage[key] = entry
+	}
+	entry.Streams++
+	entry.LastSeen = now
+
+	return &relayAccount{client: client, dest: dest, start: now, entry: entry}
+}
+
+// countIn 包装写入从客户端收到的数据的 Writer
+func (r *relayAccount) countIn(w io.Writer) io.Writer {
+	return &countingWriter{w: w, n: []*atomic.Uint64{&r.bytesIn, &r.entry.bytesIn}}
+}
+
+// countOut 包装写入发往客户端的数据的 Writer
+func (r *relayAccount) countOut(w io.Writer) io.Writer {
+	return &countingWriter{w: w, n: []*atomic.Uint64{&r.bytesOut, &r.entry.bytesOut}}
+}
+
+// add 计入不经过 Writer 的流量, 如 UDP 数据报
+func (r *relayAccount) add(in, out int) {
+	r.bytesIn.Add(uint64(in))
+	r.entry.bytesIn.Add(uint64(in))
+	r.bytesOut.Add(uint64(out))
+	r.entry.bytesOut.Add(uint64(out))
+}
+
+func (a *Accounting) close(r *relayAccount) {
+	d := time.Since(r.start)
+	a.mu.Lock()
+	r.entry.Duration += d
+	r.entry.LastSeen = time.Now()
+	a.mu.Unlock()
+	log.Printf("relay closed: %s -> %s, in: %d, out: %d, duration: %v",
+		r.client, r.dest, r.bytesIn.Load(), r.bytesOut.Load(), d.Round(time.Millisecond))
+}
+
+// snapshot 返回汇总流量, 包含进行中的转发已经传输的字节
+func (a *Accounting) snapshot() []Usage {
+	a.mu.Lock()
+	usage := make([]Usage, 0, len(a.usage))
+	for _, e := range a.usage {
+		u := e.Usage
+		u.BytesIn += e.bytesIn.Load()
+		u.BytesOut += e.bytesOut.Load()
+		usage = append(usage, u)
+	}
+	a.mu.Unlock()
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Client != usage[j].Client {
+			return usage[i].Client < usage[j].Client
+		}
+		return usage[i].Dest < usage[j].Dest
+	})
+	return usage
+}
+
+func (a *Accounting) flush() error {
+	a.mu.Lock()
+	path := a.path
+	a.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(a.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// accounting_start 定期写入流量统计, ctx 取消时最后写入一次后返回
+func accounting_start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := _accounting.flush(); err != nil {
+				log.Printf("写入流量统计失败: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := _accounting.flush(); err != nil {
+				log.Printf("写入流量统计失败: %v", err)
+			}
+		}
+	}
+}
+
+// usage_start 在独立的监听地址上提供 /usage, 默认只监听本机地址
+func usage_start(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/usage", handleUsage)
+	log.Println("流量查询服务正在监听 " + addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("无法启动流量查询服务: %v", err)
+	}
+}
+
+// handleUsage 实时查询流量汇总, ?client= 只返回该客户端
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	client := r.URL.Query().Get("client")
+	usage := make([]Usage, 0)
+	for _, u := range _accounting.snapshot() {
+		if client == "" || u.Client == client {
+			usage = append(usage, u)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 0x80 方法子协商的状态, 与 RFC 1929 相同: 0x00 成功, 其它值失败后关闭连接
+const (
+	AuthSuccess = 0x00
+	AuthFailure = 0x01
+)
+
+var (
+	// ErrTokenRejected 凭据无效, 区别于认证后端不可用
+	ErrTokenRejected = errors.New("token rejected")
+	ErrTokenExpired  = errors.New("token expired")
+)
+
+// Principal 认证通过的调用方, 随请求进入 CONNECT 等命令的处理
+type Principal struct {
+	Subject string         // 用户标识
+	ResID   string         // 请求的资源 ID
+	Claims  map[string]any // 认证后端给出的附加声明
+	Expires time.Time      // 零值表示不过期
+}
+
+func (p *Principal) String() string {
+	if p.Subject == "" {
+		return "anonymous"
+	}
+	return p.Subject
+}
+
+// Authenticator 校验 0x80 方法提交的 Token 与 ResID, client 为客户端地址;
+// 凭据无效时返回包装了 ErrTokenRejected 的错误
+type Authenticator interface {
+	Authenticate(ctx context.Context, req *AuthRequest, client string) (*Principal, error)
+}
+
+// authReason 认证失败在指标中的原因
+func authReason(err error) string {
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		return "expired"
+	case errors.Is(err, ErrTokenRejected):
+		return "rejected"
+	default:
+		return "unavailable"
+	}
+}
+
+// newAuthenticator 按 -auth 选择认证方式
+func newAuthenticator(kind, file, url, audience string) (Authenticator, error) {
+	switch kind {
+	case "", "none":
+		log.Println("未启用 Token 认证, 接受任意 Token")
+		return allowAll{}, nil
+	case "file":
+		return loadFileAuthenticator(file)
+	case "token":
+		return loadTokenAuthenticator(file, audience)
+	case "http":
+		if url == "" {
+			return nil, errors.New("-auth http requires -auth-url")
+		}
+		return &httpAuthenticator{url: url, client: &http.Client{Timeout: 5 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown authenticator %q", kind)
+	}
+}
+
+// allowAll 不校验 Token, 保持未配置认证时的行为
+type allowAll struct{}
+
+func (allowAll) Authenticate(_ context.Context, req *AuthRequest, _ string) (*Principal, error) {
+	return &Principal{ResID: req.ResID}, nil
+}
+
+// fileToken Token 文件中的一项
+type fileToken struct {
+	Token   string         `json:"token"`
+	Subject string         `json:"subject"`
+	ResIDs  []string       `json:"res_ids,omitempty"` // 为空时不限制 ResID
+	Claims  map[string]any `json:"claims,omitempty"`
+	Expires time.Time      `json:"expires,omitempty"`
+}
+
+// fileAuthenticator 从 JSON 文件加载的静态 Token 表
+type fileAuthenticator struct {
+	tokens []fileToken
+}
+
+func loadFileAuthenticator(path string) (*fileAuthenticator, error) {
+	if path == "" {
+		return nil, errors.New("-auth file requires -auth-file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []fileToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, t := range tokens {
+		if t.Token == "" || t.Subject == "" {
+			return nil, fmt.Errorf("%s: entry %d: token and subject are required", path, i)
+		}
+	}
+	return &fileAuthenticator{tokens: tokens}, nil
+}
+
+func (a *fileAuthenticator) Authenticate(_ context.Context, req *AuthRequest, _ string) (*Principal, error) {
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(req.Token)) != 1 {
+			continue
+		}
+		if !t.Expires.IsZero() && time.Now().After(t.Expires) {
+			return nil, fmt.Errorf("%s: %w", t.Subject, ErrTokenExpired)
+		}
+		if len(t.ResIDs) > 0 && !slices.Contains(t.ResIDs, req.ResID) {
+			return nil, fmt.Errorf("%s: resource %q not granted: %w", t.Subject, req.ResID, ErrTokenRejected)
+		}
+		return &Principal{Subject: t.Subject, ResID: req.ResID, Claims: t.Claims, Expires: t.Expires}, nil
+	}
+	return nil, fmt.Errorf("unknown token: %w", ErrTokenRejected)
+}
+
+// 签名 Token 为 JWS 紧凑格式 (header.payload.signature), 支持 HS256 与 EdDSA.
+// 受 TOKEN_LEN 限制整个 Token 不能超过 255 字节, 声明应尽量精简. 使用的声明:
+//
+//	sub  用户标识, 必填
+//	exp  过期时间, 必填
+//	nbf  生效时间
+//	aud  配置了 -auth-audience 时必须匹配
+//	res  允许的 ResID, 字符串或数组, 缺省不限制
+//
+// 其它声明原样放入 Principal.Claims.
+
+// clockSkew 校验 exp/nbf 时容许的时钟偏差
+const clockSkew = 30 * time.Second
+
+// tokenKey 密钥文件中的一项, HS256 使用 secret, EdDSA 使用 public_key, 均为 base64
+type tokenKey struct {
+	ID        string `json:"kid"`
+	Alg       string `json:"alg"`
+	Secret    string `json:"secret,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+
+	secret []byte
+	public ed25519.PublicKey
+}
+
+// tokenAuthenticator 用本地密钥校验签名 Token
+type tokenAuthenticator struct {
+	keys     []tokenKey
+	audience string
+}
+
+func loadTokenAuthenticator(path, audience string) (*tokenAuthenticator, error) {
+	if path == "" {
+		return nil, errors.New("-auth token requires -auth-file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []tokenKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range keys {
+		k := &keys[i]
+		switch k.Alg {
+		case "HS256":
+			if k.secret, err = base64.StdEncoding.DecodeString(k.Secret); err != nil || len(k.secret) < 32 {
+				return nil, fmt.Errorf("%s: key %q: secret must be at least 32 bytes of base64", path, k.ID)
+			}
+		case "EdDSA":
+			pub, err := base64.StdEncoding.DecodeString(k.PublicKey)
+			if err != nil || len(pub) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%s: key %q: invalid ed25519 public key", path, k.ID)
+			}
+			k.public = pub
+		default:
+			return nil, fmt.Errorf("%s: key %q: unsupported alg %q", path, k.ID, k.Alg)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return &tokenAuthenticator{keys: keys, audience: audience}, nil
+}
+
+func (a *tokenAuthenticator) Authenticate(_ context.Context, req *AuthRequest, _ string) (*Principal, error) {
+	claims, err := a.verify(req.Token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenRejected, err)
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("missing sub: %w", ErrTokenRejected)
+	}
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, fmt.Errorf("%s: missing exp: %w", sub, ErrTokenRejected)
+	}
+	now := time.Now()
+	if now.After(exp.Add(clockSkew)) {
+		return nil, fmt.Errorf("%s: %w", sub, ErrTokenExpired)
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(clockSkew).Before(nbf) {
+		return nil, fmt.Errorf("%s: not yet valid: %w", sub, ErrTokenRejected)
+	}
+	if a.audience != "" && !stringClaim(claims["aud"], a.audience) {
+		return nil, fmt.Errorf("%s: audience mismatch: %w", sub, ErrTokenRejected)
+	}
+	if res, ok := claims["res"]; ok && !stringClaim(res, req.ResID) {
+		return nil, fmt.Errorf("%s: resource %q not granted: %w", sub, req.ResID, ErrTokenRejected)
+	}
+
+	for _, c := range []string{"sub", "exp", "nbf", "iat", "aud"} {
+		delete(claims, c)
+	}
+	return &Principal{Subject: sub, ResID: req.ResID, Claims: claims, Expires: exp}, nil
+}
+
+// verify 校验签名并返回声明; alg 必须与密钥类型一致, 有 kid 时只用对应的密钥
+func (a *tokenAuthenticator) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %v", err)
+	}
+	signed := []byte(token[:len(parts[0])+1+len(parts[1])])
+
+	verified := false
+	for _, k := range a.keys {
+		if k.Alg != header.Alg || (header.Kid != "" && k.ID != header.Kid) {
+			continue
+		}
+		switch k.Alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, k.secret)
+			mac.Write(signed)
+			verified = hmac.Equal(mac.Sum(nil), sig)
+		case "EdDSA":
+			verified = ed25519.Verify(k.public, signed, sig)
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("bad signature")
+	}
+
+	claims := make(map[string]any)
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("payload: %v", err)
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func numericDate(v any) (time.Time, bool) {
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// stringClaim 声明为字符串或字符串数组时判断是否包含 want, "*" 匹配任意值
+func stringClaim(v any, want string) bool {
+	switch v := v.(type) {
+	case string:
+		return v == want || v == "*"
+	case []any:
+		for _, e := range v {
+			if s, _ := e.(string); s == want || s == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// httpAuthenticator 把 Token 交给本机的认证服务校验:
+//
+//	POST url  {"token": "...", "res_id": "...", "client": "1.2.3.4"}
+//
+// 200 返回 {"subject": "...", "claims": {...}, "expires": "RFC 3339"} 表示通过,
+// 401/403 表示拒绝, 其它状态视为服务不可用
+type httpAuthenticator struct {
+	url    string
+	client *http.Client
+}
+
+func (a *httpAuthenticator) Authenticate(ctx context.Context, req *AuthRequest, client string) (*Principal, error) {
+	body, err := json.Marshal(map[string]string{"token": req.Token, "res_id": req.ResID, "client": client})
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("auth service: %s: %w", resp.Status, ErrTokenRejected)
+	default:
+		return nil, fmt.Errorf("auth service: %s", resp.Status)
+	}
+
+	var result struct {
+		Subject string         `json:"subject"`
+		Claims  map[string]any `json:"claims"`
+		Expires time.Time      `json:"expires"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("auth service: %v", err)
+	}
+	if result.Subject == "" {
+		return nil, errors.New("auth service: empty subject")
+	}
+	return &Principal{Subject: result.Subject, ResID: req.ResID, Claims: result.Claims, Expires: result.Expires}, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signToken 生成 JWS 紧凑格式的 Token, key 为 HS256 的密钥或 ed25519 私钥
+func signToken(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	keys, err := json.Marshal([]map[string]string{
+		{"kid": "hs", "alg": "HS256", "secret": base64.StdEncoding.EncodeToString(secret)},
+		{"kid": "ed", "alg": "EdDSA", "public_key": base64.StdEncoding.EncodeToString(pub)},
+	})
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, keys, 0o600))
+	auth, err := loadTokenAuthenticator(path, "socks")
+	require.NoError(t, err)
+
+	now := time.Now()
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"sub": "alice", "exp": now.Add(time.Hour).Unix(), "aud": "socks", "res": []string{"db"}}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		resID string
+		err   error // nil 表示通过
+	}{
+		{"hs256", signToken(t, "HS256", "hs", secret, claims(nil)), "db", nil},
+		{"eddsa", signToken(t, "EdDSA", "ed", priv, claims(nil)), "db", nil},
+		{"eddsa without kid", signToken(t, "EdDSA", "", priv, claims(nil)), "db", nil},
+		{"wildcard res", signToken(t, "HS256", "hs", secret, claims(map[string]any{"res": "*"})), "web", nil},
+		{"no res claim", signToken(t, "HS256", "hs", secret, claims(map[string]any{"res": nil})), "web", nil},
+		// 以 EdDSA 公钥作为 HMAC 密钥伪造的 Token
+		{"hs256 with eddsa key", signToken(t, "HS256", "ed", []byte(pub), claims(nil)), "db", ErrTokenRejected},
+		{"eddsa header on hs256 key", signToken(t, "EdDSA", "hs", priv, claims(nil)), "db", ErrTokenRejected},
+		{"wrong secret", signToken(t, "HS256", "hs", []byte("another secret of thirty-two bytes"), claims(nil)), "db", ErrTokenRejected},
+		{"expired", signToken(t, "HS256", "hs", secret, claims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), "db", ErrTokenExpired},
+		{"expired within skew", signToken(t, "HS256", "hs", secret, claims(map[string]any{"exp": now.Add(-10 * time.Second).Unix()})), "db", nil},
+		{"missing exp", signToken(t, "HS256", "hs", secret, claims(map[string]any{"exp": nil})), "db", ErrTokenRejected},
+		{"nbf in future", signToken(t, "HS256", "hs", secret, claims(map[string]any{"nbf": now.Add(5 * time.Minute).Unix()})), "db", ErrTokenRejected},
+		{"nbf passed", signToken(t, "HS256", "hs", secret, claims(map[string]any{"nbf": now.Add(-time.Minute).Unix()})), "db", nil},
+		{"audience mismatch", signToken(t, "HS256", "hs", secret, claims(map[string]any{"aud": "other"})), "db", ErrTokenRejected},
+		{"audience list", signToken(t, "HS256", "hs", secret, claims(map[string]any{"aud": []string{"other", "socks"}})), "db", nil},
+		{"res not granted", signToken(t, "HS256", "hs", secret, claims(nil)), "web", ErrTokenRejected},
+		{"missing sub", signToken(t, "HS256", "hs", secret, claims(map[string]any{"sub": nil})), "db", ErrTokenRejected},
+		{"malformed", "not-a-token", "db", ErrTokenRejected},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := auth.Authenticate(context.Background(), &AuthRequest{Token: tc.token, ResID: tc.resID}, "127.0.0.1")
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "alice", p.Subject)
+			assert.Equal(t, tc.resID, p.ResID)
+			assert.NotContains(t, p.Claims, "sub")
+		})
+	}
+}
+
+func TestHTTPAuthenticator(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req["token"] {
+		case "good":
+			json.NewEncoder(w).Encode(map[string]any{
+				"subject": "bob",
+				"claims":  map[string]any{"client": req["client"], "res_id": req["res_id"]},
+			})
+		case "bad":
+			w.WriteHeader(http.StatusForbidden)
+		case "empty":
+			json.NewEncoder(w).Encode(map[string]any{})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	auth := &httpAuthenticator{url: srv.URL, client: srv.Client()}
+	ctx := context.Background()
+
+	p, err := auth.Authenticate(ctx, &AuthRequest{Token: "good", ResID: "db"}, "192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, "bob", p.Subject)
+	assert.Equal(t, "db", p.ResID)
+	assert.Equal(t, map[string]any{"client": "192.0.2.1", "res_id": "db"}, p.Claims)
+
+	_, err = auth.Authenticate(ctx, &AuthRequest{Token: "bad"}, "192.0.2.1")
+	assert.ErrorIs(t, err, ErrTokenRejected)
+	assert.Equal(t, "rejected", authReason(err))
+
+	// 服务异常不算凭据无效
+	for _, token := range []string{"boom", "empty"} {
+		_, err = auth.Authenticate(ctx, &AuthRequest{Token: token}, "192.0.2.1")
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrTokenRejected)
+		assert.Equal(t, "unavailable", authReason(err))
+	}
+}
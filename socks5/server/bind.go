@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BIND: 在控制连接的本地地址上打开监听, 第一个应答给出监听地址, 第二个应答在对端
+// 连入后给出对端地址, 之后控制连接与对端连接互相转发. 用于主动模式 FTP 等需要
+// 入站连接的协议.
+
+// bindConfig BIND 的配置, 由命令行参数设置
+type bindConfig struct {
+	ports     [2]uint16     // 监听端口范围, 零值由系统分配
+	timeout   time.Duration // 等待对端连入的时间
+	checkPeer bool          // 对端地址必须与请求中的 DST.ADDR 一致
+}
+
+var _bind = &bindConfig{timeout: 2 * time.Minute}
+
+// parsePortRange 解析 "443" 或 "8000-8999"
+func parsePortRange(s string) ([2]uint16, error) {
+	lo, hi, found := strings.Cut(s, "-")
+	if !found {
+		hi = lo
+	}
+	l, err1 := strconv.ParseUint(lo, 10, 16)
+	h, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || l > h {
+		return [2]uint16{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return [2]uint16{uint16(l), uint16(h)}, nil
+}
+
+// listen 在 ip 上打开监听, 配置了端口范围时从随机位置开始依次尝试
+func (c *bindConfig) listen(ip netip.Addr) (*net.TCPListener, error) {
+	if c.ports[0] == 0 && c.ports[1] == 0 {
+		return net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)))
+	}
+	n := int(c.ports[1]-c.ports[0]) + 1
+	start := rand.IntN(n)
+	for i := range n {
+		port := c.ports[0] + uint16((start+i)%n)
+		ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)))
+		if err == nil {
+			return ln, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in %d-%d", c.ports[0], c.ports[1])
+}
+
+func handlerCmdBind(cli net.Conn, req *ConnRequest, principal *Principal) error {
+	if err := _policy.allow(principal, req.Addr.Host, req.Addr.Port); err != nil {
+		log.Printf("拒绝 BIND: %v", err)
+		metricStreamsDenied.With().Inc()
+		cli.Write([]byte{Version, NotAllowed, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+
+	ctrlLocal, err := netip.ParseAddrPort(cli.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	ln, err := _bind.listen(ctrlLocal.Addr())
+	if err != nil {
+		log.Printf("BIND 监听失败: %v", err)
+		metricBinds.With("error").Inc()
+		cli.Write([]byte{Version, GeneralFailure, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+	defer ln.Close()
+
+	bnd := ln.Addr().(*net.TCPAddr).AddrPort()
+	cli.Write(appendAddrPort([]byte{Version, Success, 0x00}, bnd))
+	log.Printf("bind: %v, principal: %v, listen: %v", cli.RemoteAddr(), principal, bnd)
+
+	// 等待期间控制连接关闭则放弃; 客户端提前发来的数据在对端连入后转发
+	early := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, err := cli.Read(buf)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			ln.Close()
+		}
+		early <- buf[:n]
+	}()
+
+	peer, err := acceptPeer(ln, req.Addr, principal)
+	cli.SetReadDeadline(time.Unix(1, 0))
+	pending := <-early
+	cli.SetReadDeadline(time.Time{})
+	if err != nil {
+		result := "error"
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			result = "timeout"
+			cli.Write([]byte{Version, TTLExpired, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		} else {
+			cli.Write([]byte{Version, GeneralFailure, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		}
+		log.Printf("BIND 等待对端失败: %v", err)
+		metricBinds.With(result).Inc()
+		return err
+	}
+	defer peer.Close()
+	ln.Close()
+
+	peerAddr := peer.RemoteAddr().(*net.TCPAddr).AddrPort()
+	peerAddr = netip.AddrPortFrom(peerAddr.Addr().Unmap(), peerAddr.Port())
+	cli.Write(appendAddrPort([]byte{Version, Success, 0x00}, peerAddr))
+	metricBinds.With("connected").Inc()
+	log.Printf("bind connected: %v <- %v", cli.RemoteAddr(), peerAddr)
+
+	if len(pending) > 0 {
+		if _, err := peer.Write(pending); err != nil {
+			return err
+		}
+	}
+
+	client, _, _ := net.SplitHostPort(cli.RemoteAddr().String())
+	acct := _accounting.open(client, "bind/"+peerAddr.String())
+	defer _accounting.close(acct)
+
+	in, out := transferData(cli, peer, acct)
+	metricBytes.With(client, "in").Add(float64(in + int64(len(pending))))
+	metricBytes.With(client, "out").Add(float64(out))
+	return nil
+}
+
+// acceptPeer 等待对端连入, 拒绝授权策略不允许的对端以及启用 checkPeer 时
+// 地址与 want 不一致的对端, 并继续等待
+func acceptPeer(ln *net.TCPListener, want *Addr, principal *Principal) (net.Conn, error) {
+	ln.SetDeadline(time.Now().Add(_bind.timeout))
+
+	// 未声明对端地址 (全零) 时无从检查
+	check := _bind.checkPeer
+	if ip, err := netip.ParseAddr(want.Host); err == nil && ip.IsUnspecified() {
+		check = false
+	}
+	var allowed []netip.Addr
+	if check {
+		ips, err := net.LookupIP(want.Host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if a, ok := netip.AddrFromSlice(ip); ok {
+				allowed = append(allowed, a.Unmap())
+			}
+		}
+	}
+
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		ip := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+		// 对端的源端口是临时端口, 按请求中的 DST.PORT 检查
+		if err := _policy.allow(principal, ip.String(), want.Port); err != nil {
+			log.Printf("BIND 拒绝对端 %v: %v", conn.RemoteAddr(), err)
+			metricBinds.With("denied").Inc()
+			conn.Close()
+			continue
+		}
+		if !check {
+			return conn, nil
+		}
+		for _, a := range allowed {
+			if a == ip {
+				return conn, nil
+			}
+		}
+		log.Printf("BIND 拒绝对端 %v, 期望 %s", conn.RemoteAddr(), want.Host)
+		metricBinds.With("mismatch").Inc()
+		conn.Close()
+	}
+}
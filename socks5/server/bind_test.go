@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useBindConfig 在测试期间修改 BIND 配置
+func useBindConfig(t *testing.T, c bindConfig) {
+	t.Helper()
+	old := *_bind
+	*_bind = c
+	t.Cleanup(func() { *_bind = old })
+}
+
+// readBindReply 读取 IPv4 地址的 BIND 应答, 返回应答码与地址
+func readBindReply(t *testing.T, conn net.Conn) (byte, netip.AddrPort) {
+	t.Helper()
+	reply := make([]byte, 10)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.EqualValues(t, Version, reply[0])
+	require.EqualValues(t, 0x01, reply[3])
+	return reply[1], netip.AddrPortFrom(netip.AddrFrom4([4]byte(reply[4:8])), uint16(reply[8])<<8|uint16(reply[9]))
+}
+
+func TestParsePortRange(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want [2]uint16
+		ok   bool
+	}{
+		{"443", [2]uint16{443, 443}, true},
+		{"8000-8999", [2]uint16{8000, 8999}, true},
+		{"0-65535", [2]uint16{0, 65535}, true},
+		{"9000-8000", [2]uint16{}, false},
+		{"65536", [2]uint16{}, false},
+		{"80-", [2]uint16{}, false},
+		{"http", [2]uint16{}, false},
+		{"", [2]uint16{}, false},
+	} {
+		got, err := parsePortRange(tc.in)
+		if tc.ok {
+			assert.NoError(t, err, tc.in)
+			assert.Equal(t, tc.want, got, tc.in)
+		} else {
+			assert.Error(t, err, tc.in)
+		}
+	}
+}
+
+func TestBindListenRange(t *testing.T) {
+	ip := netip.MustParseAddr("127.0.0.1")
+	// 占用一个端口, 范围内没有空闲端口时失败
+	busy, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer busy.Close()
+	lo := uint16(busy.Addr().(*net.TCPAddr).Port)
+	_, err = (&bindConfig{ports: [2]uint16{lo, lo}}).listen(ip)
+	assert.Error(t, err)
+
+	if lo > 65535-5 {
+		t.Skip("no room for a port range")
+	}
+	c := &bindConfig{ports: [2]uint16{lo + 1, lo + 5}}
+	for range 3 {
+		ln, err := c.listen(ip)
+		require.NoError(t, err)
+		defer ln.Close()
+		port := uint16(ln.Addr().(*net.TCPAddr).Port)
+		assert.True(t, port > lo && port <= lo+5, "port %d outside %d-%d", port, lo+1, lo+5)
+	}
+}
+
+func TestBindPeerTimeout(t *testing.T) {
+	useBindConfig(t, bindConfig{timeout: 100 * time.Millisecond})
+	ctrl, srv := controlPair(t)
+	req := &ConnRequest{Cmd: 0x02, Addr: &Addr{Type: 0x01, Host: "0.0.0.0", Port: 21}}
+	done := make(chan error, 1)
+	go func() { done <- handlerCmdBind(srv, req, &Principal{}) }()
+
+	code, bnd := readBindReply(t, ctrl)
+	require.EqualValues(t, Success, code)
+	assert.Equal(t, "127.0.0.1", bnd.Addr().String())
+
+	code, _ = readBindReply(t, ctrl)
+	assert.EqualValues(t, TTLExpired, code)
+	assert.Error(t, <-done)
+
+	// 超时后监听已关闭
+	_, err := net.DialTimeout("tcp", bnd.String(), time.Second)
+	assert.Error(t, err)
+}
+
+func TestBindCheckPeer(t *testing.T) {
+	useBindConfig(t, bindConfig{timeout: 2 * time.Second, checkPeer: true})
+	ctrl, srv := controlPair(t)
+	req := &ConnRequest{Cmd: 0x02, Addr: &Addr{Type: 0x01, Host: "127.0.0.2", Port: 21}}
+	done := make(chan error, 1)
+	go func() { done <- handlerCmdBind(srv, req, &Principal{}) }()
+
+	code, bnd := readBindReply(t, ctrl)
+	require.EqualValues(t, Success, code)
+
+	// 来自 127.0.0.1 的对端与声明的地址不一致, 被关闭
+	wrong, err := net.Dial("tcp", bnd.String())
+	require.NoError(t, err)
+	defer wrong.Close()
+	wrong.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = wrong.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, os.ErrDeadlineExceeded, "mismatched peer was not closed")
+
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	peer, err := d.Dial("tcp", bnd.String())
+	require.NoError(t, err)
+	defer peer.Close()
+
+	code, addr := readBindReply(t, ctrl)
+	require.EqualValues(t, Success, code)
+	assert.Equal(t, peer.LocalAddr().String(), addr.String())
+
+	// 第二个应答之后双向转发
+	_, err = peer.Write([]byte("220 ready"))
+	require.NoError(t, err)
+	buf := make([]byte, 9)
+	_, err = io.ReadFull(ctrl, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "220 ready", string(buf))
+
+	ctrl.Close()
+	peer.Close()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("bind relay did not finish")
+	}
+}
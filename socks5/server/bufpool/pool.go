@@ -1,6 +1,8 @@
 // Package pool provides a pool of []byte.
 package bufpool
 
+import "sync/atomic"
+
 const (
 	// MaxSegmentSize is the largest possible UDP datagram size.
 	MaxSegmentSize = (1 << 16) - 1
@@ -12,12 +14,39 @@ const (
 	RelayBufferSize = 20 << 10
 )
 
+// Stats describes the usage of the default allocator.
+type Stats struct {
+	Gets       uint64 // successful Get calls
+	Puts       uint64 // successful Put calls
+	InUseBytes int64  // capacity of buffers currently checked out
+}
+
+var (
+	_gets, _puts atomic.Uint64
+	_inUse       atomic.Int64
+)
+
 // Get gets a []byte from default allocator with most appropriate cap.
 func Get(size int) []byte {
-	return _allocator.Get(size)
+	buf := _allocator.Get(size)
+	if buf != nil {
+		_gets.Add(1)
+		_inUse.Add(int64(cap(buf)))
+	}
+	return buf
 }
 
 // Put returns a []byte to default allocator for future use.
 func Put(buf []byte) error {
-	return _allocator.Put(buf)
+	if err := _allocator.Put(buf); err != nil {
+		return err
+	}
+	_puts.Add(1)
+	_inUse.Add(-int64(cap(buf)))
+	return nil
+}
+
+// ReadStats returns the usage of the default allocator.
+func ReadStats() Stats {
+	return Stats{Gets: _gets.Load(), Puts: _puts.Load(), InUseBytes: _inUse.Load()}
 }
@@ -6,29 +6,47 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"time"
 
 	"test.com/server/bufpool"
 )
 
-func handlerCmdConnect(cli net.Conn, req *ConnRequest) error {
+func handlerCmdConnect(cli net.Conn, req *ConnRequest, principal *Principal) error {
+	if err := _policy.allow(principal, req.Addr.Host, req.Addr.Port); err != nil {
+		log.Printf("拒绝连接: %v", err)
+		metricStreamsDenied.With().Inc()
+		cli.Write([]byte{Version, NotAllowed, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+
 	cli.Write([]byte{Version, Success, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 
 	dstAddr := req.Addr.Host + ":" + strconv.Itoa(int(req.Addr.Port))
 
-	log.Printf("proxy connect: %v", dstAddr)
+	log.Printf("proxy connect: %v, principal: %v", dstAddr, principal)
 
+	start := time.Now()
 	dstCli, err := net.Dial("tcp", dstAddr)
 	if err != nil {
+		metricStreamsFailed.With().Inc()
 		cli.Write([]byte{Version, Unreachable, 0x00})
 		return err
 	}
 	defer dstCli.Close()
+	metricDialLatency.With().Observe(time.Since(start).Seconds())
+	metricStreamsOpened.With().Inc()
 
 	log.Printf("proxy connect success: %v", dstAddr)
 
 	cli.Write([]byte{Version, Success, 0x00})
 
-	transferData(cli, dstCli)
+	client, _, _ := net.SplitHostPort(cli.RemoteAddr().String())
+	acct := _accounting.open(client, dstAddr)
+	defer _accounting.close(acct)
+
+	in, out := transferData(cli, dstCli, acct)
+	metricBytes.With(client, "in").Add(float64(in))
+	metricBytes.With(client, "out").Add(float64(out))
 
 	return err
 }
@@ -37,14 +55,18 @@ const (
 	BufSize = 20 << 10
 )
 
-func transferData(src, dst net.Conn) {
-	// 双向拷贝数据
+// transferData 双向拷贝数据并计入 acct, 返回 src 发出与收到的字节数
+func transferData(src, dst net.Conn, acct *relayAccount) (in, out int64) {
+	done := make(chan struct{})
 	go func() {
-		io.Copy(dst, src)
+		in, _ = io.Copy(acct.countIn(dst), src)
 		dst.Close()
+		close(done)
 	}()
-	io.Copy(src, dst)
+	out, _ = io.Copy(acct.countOut(src), dst)
 	src.Close()
+	<-done
+	return in, out
 }
 
 func exchangeBuffer2(src, dst net.Conn) (err error) {
@@ -79,7 +101,6 @@ func exchangeBuffer2(src, dst net.Conn) (err error) {
 
 	}
 	log.Printf("exchangeBuffer err: %v", err)
-	bufpool.Put(buf)
 	return err
 }
 
@@ -118,7 +139,6 @@ func exchangeBuffer1(src, dst net.Conn) (err error) {
 		}
 	}
 	log.Printf("exchangeBuffer err: %v", err)
-	bufpool.Put(buf)
 	return err
 }
 
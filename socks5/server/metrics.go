@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"test.com/server/bufpool"
+	"test.com/server/metrics"
+)
+
+// 以 Prometheus 文本格式导出的指标, 通过 -metrics 启用
+
+var (
+	_metrics = metrics.NewRegistry()
+
+	metricConnections = _metrics.NewGauge("socks_connections_active",
+		"Client connections currently open.")
+	metricAuthFailures = _metrics.NewCounter("socks_auth_failures_total",
+		"Handshakes or token authentications that failed, by reason.", "reason")
+	metricStreamsOpened = _metrics.NewCounter("socks_streams_opened_total",
+		"CONNECT requests relayed to their destination.")
+	metricStreamsFailed = _metrics.NewCounter("socks_streams_failed_total",
+		"CONNECT requests whose destination could not be reached.")
+	metricStreamsDenied = _metrics.NewCounter("socks_streams_denied_total",
+		"CONNECT requests rejected by the ResID policy.")
+	metricBinds = _metrics.NewCounter("socks_binds_total",
+		"BIND requests by result: connected, timeout, mismatch or denied (peer rejected) or error.", "result")
+	metricUDPAssociations = _metrics.NewGauge("socks_udp_associations_active",
+		"UDP ASSOCIATE relays currently open.")
+	metricDatagrams = _metrics.NewCounter("socks_udp_datagrams_total",
+		"Datagrams relayed; in is received from the client, out is sent to it.", "direction")
+	metricDatagramsDropped = _metrics.NewCounter("socks_udp_datagrams_dropped_total",
+		"Datagrams dropped by the UDP relay, by reason.", "reason")
+	metricBytes = _metrics.NewCounter("socks_client_bytes_total",
+		"Bytes relayed per client address; in is received from the client, out is sent to it.", "client", "direction")
+	metricDialLatency = _metrics.NewHistogram("socks_dial_duration_seconds",
+		"Time to connect to the CONNECT destination.", metrics.DefLatencyBuckets)
+)
+
+func init() {
+	_metrics.NewCounterFunc("socks_bufpool_gets_total", "Buffers taken from the pool.", func() float64 {
+		return float64(bufpool.ReadStats().Gets)
+	})
+	_metrics.NewCounterFunc("socks_bufpool_puts_total", "Buffers returned to the pool.", func() float64 {
+		return float64(bufpool.ReadStats().Puts)
+	})
+	_metrics.NewGaugeFunc("socks_bufpool_in_use_bytes", "Capacity of pool buffers currently checked out.", func() float64 {
+		return float64(bufpool.ReadStats().InUseBytes)
+	})
+}
+
+func metrics_start(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", _metrics)
+	log.Println("指标服务正在监听 " + addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("无法启动指标服务: %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+// Package metrics 与 yamux/common/metrics.go 是同一份实现; socks5 单独构建,
+// 不能引用 yamux 模块, 修改时两处保持一致
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 以 Prometheus 文本格式 (0.0.4) 导出指标的最小实现, 只包含本项目用到的
+// counter、gauge 与 histogram
+
+// DefLatencyBuckets 建连耗时直方图的默认分桶, 单位秒
+var DefLatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricFamily interface {
+	writeTo(w *bufio.Writer)
+}
+
+// Registry 指标集合, 实现 http.Handler
+type Registry struct {
+	mu       sync.Mutex
+	families []metricFamily
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f metricFamily) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.mu.Lock()
+	families := append([]metricFamily(nil), r.families...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.writeTo(bw)
+	}
+	bw.Flush()
+}
+
+// Float 可原子更新的 float64
+type Float struct {
+	bits atomic.Uint64
+}
+
+func (f *Float) Add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *Float) Inc() { f.Add(1) }
+
+func (f *Float) Set(v float64) { f.bits.Store(math.Float64bits(v)) }
+
+func (f *Float) Value() float64 { return math.Float64frombits(f.bits.Load()) }
+
+// vec 按标签值组合保存序列
+type vec[T any] struct {
+	name, help, typ string
+	labels          []string
+
+	mu     sync.Mutex
+	series map[string]*T
+	values map[string][]string
+	newT   func() *T
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: want %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = v.newT()
+		v.series[key] = s
+		v.values[key] = append([]string(nil), values...)
+	}
+	return s
+}
+
+// each 按标签值排序遍历, 保证输出稳定
+func (v *vec[T]) each(fn func(labels string, s *T)) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	type item struct {
+		labels string
+		s      *T
+	}
+	items := make([]item, len(keys))
+	for i, k := range keys {
+		items[i] = item{formatLabels(v.labels, v.values[k]), v.series[k]}
+	}
+	v.mu.Unlock()
+
+	for _, it := range items {
+		fn(it.labels, it.s)
+	}
+}
+
+func (v *vec[T]) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.typ)
+}
+
+func newVec[T any](name, help, typ string, labels []string, newT func() *T) *vec[T] {
+	return &vec[T]{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*T),
+		values: make(map[string][]string),
+		newT:   newT,
+	}
+}
+
+// CounterVec 单调递增计数器
+type CounterVec struct {
+	*vec[Float]
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels, func() *Float { return new(Float) })}
+	r.register(c)
+	return c
+}
+
+// With 返回标签值对应的计数器, 没有标签时不传参数
+func (c *CounterVec) With(values ...string) *Float {
+	return c.with(values)
+}
+
+func (c *CounterVec) writeTo(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, f *Float) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatFloat(f.Value()))
+	})
+}
+
+// GaugeVec 可增可减的瞬时值
+type GaugeVec struct {
+	*vec[Float]
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels, func() *Float { return new(Float) })}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeVec) With(values ...string) *Float {
+	return g.with(values)
+}
+
+func (g *GaugeVec) writeTo(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.each(func(labels string, f *Float) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatFloat(f.Value()))
+	})
+}
+
+// valueFunc 导出时调用 fn 取值的单个序列
+type valueFunc struct {
+	name, help, typ string
+	fn              func() float64
+}
+
+// NewGaugeFunc 导出时调用 fn 取值
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&valueFunc{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// NewCounterFunc 导出时调用 fn 取值, fn 必须单调递增
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&valueFunc{name: name, help: help, typ: "counter", fn: fn})
+}
+
+func (f *valueFunc) writeTo(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", f.name, escapeHelp(f.help), f.name, f.typ, f.name, formatFloat(f.fn()))
+}
+
+// Histogram 直方图序列
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64 // 每个桶内的样本数, 导出时累加
+	count  atomic.Uint64
+	sum    Float
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	if i < len(h.counts) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	h.sum.Add(v)
+}
+
+// HistogramVec 按标签值划分的直方图
+type HistogramVec struct {
+	*vec[Histogram]
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	upper := append([]float64(nil), buckets...)
+	sort.Float64s(upper)
+	h := &HistogramVec{newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{upper: upper, counts: make([]atomic.Uint64, len(upper))}
+	})}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values)
+}
+
+func (h *HistogramVec) writeTo(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, s *Histogram) {
+		var cum uint64
+		for i, upper := range s.upper {
+			cum += s.counts[i].Load()
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLE(labels, formatFloat(upper)), cum)
+		}
+		count := s.count.Load()
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLE(labels, "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(s.sum.Value()))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, count)
+	})
+}
+
+func withLE(labels, le string) string {
+	if labels == "" {
+		return `{le="` + le + `"}`
+	}
+	return labels[:len(labels)-1] + `,le="` + le + `"}`
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
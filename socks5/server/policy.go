@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 策略文件 (JSON) 按 ResID 限定可连接的目的地址, 可按认证主体进一步收窄:
+//
+//	{
+//	  "resources": {
+//	    "db": {"hosts": ["db.internal"], "cidrs": ["10.1.0.0/16"], "ports": ["5432"]},
+//	    "web": {"domains": ["corp.example"], "ports": ["80", "443", "8000-8999"]}
+//	  },
+//	  "subjects": {
+//	    "alice": {"web": {"ports": ["443"]}}
+//	  }
+//	}
+//
+// 签名 Token 还可以在 allow 声明中携带同样格式的规则, 只对该 Token 生效.
+// 目的地址必须同时满足 ResID 的规则与所有收窄规则; 未知的 ResID 一律拒绝.
+
+var ErrNotAllowed = errors.New("not allowed by ruleset")
+
+// Rule 允许的目的地址, 为空的字段不限制该项
+type Rule struct {
+	Hosts   []string `json:"hosts,omitempty"`   // 主机名或 IP, 精确匹配
+	Domains []string `json:"domains,omitempty"` // 域名后缀, 匹配自身及子域名
+	CIDRs   []string `json:"cidrs,omitempty"`   // 只匹配以 IP 给出的目的地址, 不解析域名
+	Ports   []string `json:"ports,omitempty"`   // "443" 或 "8000-8999"
+
+	cidrs []netip.Prefix
+	ports [][2]uint16
+}
+
+func (r *Rule) compile() error {
+	for i, h := range r.Hosts {
+		r.Hosts[i] = normalizeHost(h)
+	}
+	for i, d := range r.Domains {
+		r.Domains[i] = strings.TrimPrefix(normalizeHost(d), ".")
+	}
+	r.cidrs = r.cidrs[:0]
+	for _, c := range r.CIDRs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return err
+		}
+		r.cidrs = append(r.cidrs, p.Masked())
+	}
+	r.ports = r.ports[:0]
+	for _, p := range r.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return err
+		}
+		r.ports = append(r.ports, pr)
+	}
+	return nil
+}
+
+// match host 已经过 normalizeHost
+func (r *Rule) match(host string, port uint16) bool {
+	return r.matchHost(host) && r.matchPort(port)
+}
+
+func (r *Rule) matchHost(host string) bool {
+	if len(r.Hosts) == 0 && len(r.Domains) == 0 && len(r.cidrs) == 0 {
+		return true
+	}
+	for _, h := range r.Hosts {
+		if h == host {
+			return true
+		}
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		for _, p := range r.cidrs {
+			if p.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, d := range r.Domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchPort(port uint16) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, pr := range r.ports {
+		if port >= pr[0] && port <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHost 小写并去掉结尾的点, IP 统一为规范形式
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap().String()
+	}
+	return host
+}
+
+type policyFile struct {
+	Resources map[string]*Rule `json:"resources"`
+	// Subjects 认证主体 -> ResID -> 收窄规则
+	Subjects map[string]map[string]*Rule `json:"subjects,omitempty"`
+}
+
+func (f *policyFile) compile() error {
+	for id, r := range f.Resources {
+		if r == nil {
+			return fmt.Errorf("resource %q: empty rule", id)
+		}
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("resource %q: %w", id, err)
+		}
+	}
+	for sub, rules := range f.Subjects {
+		for id, r := range rules {
+			if r == nil {
+				return fmt.Errorf("subject %q, resource %q: empty rule", sub, id)
+			}
+			if err := r.compile(); err != nil {
+				return fmt.Errorf("subject %q, resource %q: %w", sub, id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Policy ResID 授权策略, 文件修改后自动重新加载; 未配置时允许所有目的地址
+type Policy struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	rules   atomic.Pointer[policyFile]
+}
+
+var _policy = &Policy{}
+
+// load 加载 path, 之后的 reload 检查同一文件
+func (p *Policy) load(path string) error {
+	p.mu.Lock()
+	p.path = path
+	p.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	_, err := p.reload()
+	return err
+}
+
+// reload 文件修改时间变化时重新加载, 解析失败保留原有策略
+func (p *Policy) reload() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.path == "" {
+		return false, nil
+	}
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return false, err
+	}
+	if fi.ModTime().Equal(p.modTime) && p.rules.Load() != nil {
+		return false, nil
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return false, err
+	}
+	f := &policyFile{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return false, fmt.Errorf("%s: %w", p.path, err)
+	}
+	if err := f.compile(); err != nil {
+		return false, fmt.Errorf("%s: %w", p.path, err)
+	}
+	p.rules.Store(f)
+	p.modTime = fi.ModTime()
+	return true, nil
+}
+
+// allow 检查 principal 能否连接 host:port, 拒绝时返回包装了 ErrNotAllowed 的错误
+func (p *Policy) allow(principal *Principal, host string, port uint16) error {
+	f := p.rules.Load()
+	if f == nil {
+		return nil
+	}
+	host = normalizeHost(host)
+	dest := host + ":" + strconv.Itoa(int(port))
+
+	r, ok := f.Resources[principal.ResID]
+	if !ok {
+		return fmt.Errorf("%v: unknown resource %q: %w", principal, principal.ResID, ErrNotAllowed)
+	}
+	if !r.match(host, port) {
+		return fmt.Errorf("%v: %s not in resource %q: %w", principal, dest, principal.ResID, ErrNotAllowed)
+	}
+	if r, ok := f.Subjects[principal.Subject][principal.ResID]; ok && !r.match(host, port) {
+		return fmt.Errorf("%v: %s not allowed for subject: %w", principal, dest, ErrNotAllowed)
+	}
+	if v, ok := principal.Claims["allow"]; ok {
+		r, err := claimRule(v)
+		if err != nil {
+			return fmt.Errorf("%v: allow claim: %v: %w", principal, err, ErrNotAllowed)
+		}
+		if !r.match(host, port) {
+			return fmt.Errorf("%v: %s not allowed by token: %w", principal, dest, ErrNotAllowed)
+		}
+	}
+	return nil
+}
+
+// claimRule 把 Token 中的 allow 声明解析为规则
+func claimRule(v any) (*Rule, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rule{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, r.compile()
+}
+
+func policy_start(interval time.Duration) {
+	for range time.Tick(interval) {
+		changed, err := _policy.reload()
+		if err != nil {
+			log.Printf("重新加载授权策略失败: %v", err)
+		} else if changed {
+			log.Println("授权策略已重新加载")
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `{
+  "resources": {
+    "db": {"hosts": ["db.internal"], "cidrs": ["10.1.0.0/16", "fd00::/64"], "ports": ["5432"]},
+    "web": {"domains": ["corp.example"], "ports": ["80", "8000-8999"]}
+  },
+  "subjects": {
+    "alice": {"web": {"ports": ["80"]}}
+  }
+}`
+
+// writePolicy 写入策略文件并把修改时间设为 mtime, 保证 reload 能发现变化
+func writePolicy(t *testing.T, path, data string, mtime time.Time) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestPolicyAllow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, testPolicy, time.Now())
+	p := &Policy{}
+	require.NoError(t, p.load(path))
+
+	for _, tc := range []struct {
+		name    string
+		subject string
+		resID   string
+		host    string
+		port    uint16
+		allowed bool
+	}{
+		{"unknown resid", "bob", "admin", "db.internal", 5432, false},
+		{"empty resid", "bob", "", "db.internal", 5432, false},
+		{"exact host", "bob", "db", "db.internal", 5432, true},
+		{"exact host case and dot", "bob", "db", "DB.Internal.", 5432, true},
+		{"exact host is not a suffix", "bob", "db", "replica.db.internal", 5432, false},
+		{"domain itself", "bob", "web", "corp.example", 80, true},
+		{"domain suffix", "bob", "web", "intranet.corp.example", 80, true},
+		{"domain lookalike", "bob", "web", "evilcorp.example", 80, false},
+		{"ip in cidr", "bob", "db", "10.1.2.3", 5432, true},
+		{"ip out of cidr", "bob", "db", "10.2.0.1", 5432, false},
+		{"ipv4-mapped ip in cidr", "bob", "db", "::ffff:10.1.2.3", 5432, true},
+		{"ipv6 in cidr", "bob", "db", "fd00::1", 5432, true},
+		{"ipv6 out of cidr", "bob", "db", "fd00:0:0:1::1", 5432, false},
+		{"ip does not match domain", "bob", "web", "192.0.2.1", 80, false},
+		{"port not allowed", "bob", "db", "db.internal", 5433, false},
+		{"port range low", "bob", "web", "corp.example", 8000, true},
+		{"port range high", "bob", "web", "corp.example", 8999, true},
+		{"port above range", "bob", "web", "corp.example", 9000, false},
+		{"subject narrowed port", "alice", "web", "corp.example", 80, true},
+		{"subject narrowed range", "alice", "web", "corp.example", 8080, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := p.allow(&Principal{Subject: tc.subject, ResID: tc.resID}, tc.host, tc.port)
+			if tc.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrNotAllowed)
+			}
+		})
+	}
+
+	// Token 中的 allow 声明进一步收窄
+	claims := map[string]any{"allow": map[string]any{"ports": []any{"8080"}}}
+	assert.NoError(t, p.allow(&Principal{Subject: "bob", ResID: "web", Claims: claims}, "corp.example", 8080))
+	assert.ErrorIs(t, p.allow(&Principal{Subject: "bob", ResID: "web", Claims: claims}, "corp.example", 80), ErrNotAllowed)
+}
+
+func TestPolicyUnconfigured(t *testing.T) {
+	p := &Policy{}
+	require.NoError(t, p.load(""))
+	assert.NoError(t, p.allow(&Principal{}, "anything.example", 25))
+}
+
+func TestPolicyReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	now := time.Now()
+	writePolicy(t, path, testPolicy, now.Add(-2*time.Minute))
+	p := &Policy{}
+	require.NoError(t, p.load(path))
+	alice := &Principal{Subject: "alice", ResID: "db"}
+	require.NoError(t, p.allow(alice, "db.internal", 5432))
+
+	// 解析失败时保留原有策略
+	writePolicy(t, path, `{"resources": {"db": {"ports": ["not-a-port"]}}}`, now.Add(-time.Minute))
+	changed, err := p.reload()
+	assert.Error(t, err)
+	assert.False(t, changed)
+	assert.NoError(t, p.allow(alice, "db.internal", 5432))
+
+	writePolicy(t, path, `{"resources": {"db": {"hosts": ["db2.internal"]`, now.Add(-30*time.Second))
+	_, err = p.reload()
+	assert.Error(t, err)
+	assert.NoError(t, p.allow(alice, "db.internal", 5432))
+
+	// 修复后生效
+	writePolicy(t, path, `{"resources": {"db": {"hosts": ["db2.internal"]}}}`, now)
+	changed, err = p.reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.ErrorIs(t, p.allow(alice, "db.internal", 5432), ErrNotAllowed)
+	assert.NoError(t, p.allow(alice, "db2.internal", 5432))
+
+	// 文件未修改时不重新加载
+	changed, err = p.reload()
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
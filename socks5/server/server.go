@@ -1,8 +1,72 @@
 package main
 
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
 func main() {
+	metricsAddr := flag.String("metrics", "", "Prometheus /metrics 监听地址, 留空不启用")
+	httpAddr := flag.String("http", "0.0.0.0:8080", "HTTP 服务监听地址")
+	usageAddr := flag.String("usage", "127.0.0.1:8081", "/usage 流量查询监听地址, 留空不启用")
+	usageFile := flag.String("usage-file", "usage.json", "流量统计文件, 留空只保存在内存中")
+	usageFlush := flag.Duration("usage-flush", time.Minute, "流量统计写入文件的间隔")
+	authKind := flag.String("auth", "none", "Token 认证方式: none, file (静态 Token 文件), token (本地密钥校验签名 Token), http (本机认证服务)")
+	authFile := flag.String("auth-file", "", "-auth file 的 Token 文件或 -auth token 的密钥文件")
+	authURL := flag.String("auth-url", "", "-auth http 的认证服务地址")
+	authAudience := flag.String("auth-audience", "", "-auth token 要求的 aud 声明, 留空不检查")
+	policyFile := flag.String("policy", "", "ResID 授权策略文件, 留空不限制目的地址")
+	policyReload := flag.Duration("policy-reload", 10*time.Second, "检查授权策略文件是否修改的间隔")
+	bindPorts := flag.String("bind-ports", "", "BIND 监听端口范围, 如 40000-40100, 留空由系统分配")
+	flag.DurationVar(&_bind.timeout, "bind-timeout", _bind.timeout, "BIND 等待对端连入的时间")
+	flag.BoolVar(&_bind.checkPeer, "bind-check-peer", false, "BIND 只接受地址与请求中 DST.ADDR 一致的对端")
+	flag.BoolVar(&_udp.anyPort, "udp-any-port", false, "UDP ASSOCIATE 允许请求不声明客户端端口, 由第一个令牌正确的数据报确定")
+	flag.Parse()
+
+	auth, err := newAuthenticator(*authKind, *authFile, *authURL, *authAudience)
+	if err != nil {
+		log.Fatalf("无法加载认证配置: %v", err)
+	}
+	_authenticator = auth
+
+	if *bindPorts != "" {
+		if _bind.ports, err = parsePortRange(*bindPorts); err != nil {
+			log.Fatalf("-bind-ports: %v", err)
+		}
+	}
+
+	if err := _policy.load(*policyFile); err != nil {
+		log.Fatalf("无法加载授权策略: %v", err)
+	}
+	if *policyFile != "" {
+		go policy_start(*policyReload)
+	}
+
+	if err := _accounting.load(*usageFile); err != nil {
+		log.Fatalf("无法加载流量统计: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	flushed := make(chan struct{})
+	go func() {
+		accounting_start(ctx, *usageFlush)
+		close(flushed)
+	}()
 	go socks_start(true)
-	go http_start()
+	go http_start(*httpAddr)
+	if *usageAddr != "" {
+		go usage_start(*usageAddr)
+	}
+	if *metricsAddr != "" {
+		go metrics_start(*metricsAddr)
+	}
 
-	select {}
+	<-ctx.Done()
+	log.Println("正在退出")
+	<-flushed
 }
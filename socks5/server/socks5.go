@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
@@ -8,6 +9,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"time"
 )
 
 type AuthRequest struct {
@@ -43,8 +45,11 @@ const (
 	// SOCKS5 协议版本
 	Version = 0x05
 
-	Success     = 0x00
-	Unreachable = 0x03
+	Success        = 0x00
+	GeneralFailure = 0x01
+	NotAllowed     = 0x02
+	Unreachable    = 0x03
+	TTLExpired     = 0x06
 
 	//
 	MethodToken        = 0x80
@@ -58,6 +63,9 @@ const (
 	CertFile = "../../cert/test.crt"
 	// 私钥文件
 	KeyFile = "../../cert/test.key"
+
+	// 认证后端的超时
+	authTimeout = 5 * time.Second
 )
 
 var (
@@ -65,6 +73,9 @@ var (
 	ErrBadMethod  = errors.New("bad method")
 )
 
+// _authenticator 校验 Token, 由 -auth 配置
+var _authenticator Authenticator = allowAll{}
+
 func socks_start(useTLS bool) {
 	var listener net.Listener
 	var err error
@@ -110,21 +121,37 @@ func socks_start(useTLS bool) {
 
 func handleConnection(conn net.Conn) error {
 	defer conn.Close()
+	metricConnections.With().Inc()
+	defer metricConnections.With().Add(-1)
 
 	// handshake
 	if err := socks5Handshake(conn); err != nil {
 		log.Printf("握手失败: %v", err)
+		metricAuthFailures.With("handshake").Inc()
 		return err
 	}
 
 	// authentication
-	_, err := Authentication(conn)
+	authReq, err := Authentication(conn)
 	if err != nil {
 		log.Printf("认证失败: %v", err)
+		metricAuthFailures.With("malformed").Inc()
+		conn.Write([]byte{MethodToken, AuthFailure})
+		return err
+	}
+
+	client, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	principal, err := _authenticator.Authenticate(ctx, authReq, client)
+	cancel()
+	if err != nil {
+		log.Printf("认证失败: %s, ResID: %s: %v", client, authReq.ResID, err)
+		metricAuthFailures.With(authReason(err)).Inc()
+		conn.Write([]byte{MethodToken, AuthFailure})
 		return err
 	}
 
-	conn.Write([]byte{MethodToken, 0x00}) // 认证成功
+	conn.Write([]byte{MethodToken, AuthSuccess}) // 认证成功
 
 	// connection
 	connReq, err := Connection(conn)
@@ -138,7 +165,13 @@ func handleConnection(conn net.Conn) error {
 
 		handlerCmdGatewaySate(conn)
 	case 0x01: // CMD_CONNECT
-		handlerCmdConnect(conn, connReq)
+		handlerCmdConnect(conn, connReq, principal)
+	case 0x02: // CMD_BIND
+		// 两个应答都由 handlerCmdBind 发出
+		return handlerCmdBind(conn, connReq, principal)
+	case 0x03: // CMD_UDP_ASSOCIATE
+		// 应答由 handlerCmdUDPAssociate 发出
+		return handlerCmdUDPAssociate(conn, connReq, principal)
 	}
 
 	// // 代理连接
@@ -235,7 +268,7 @@ func Authentication(conn net.Conn) (*AuthRequest, error) {
 	req.Token = token
 	req.ResID = rid
 
-	log.Printf("Token: %s, ResID: %s", req.Token, req.ResID)
+	log.Printf("ResID: %s", req.ResID)
 
 	return req, nil
 }
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"test.com/server/bufpool"
+)
+
+// UDP ASSOCIATE: 每个关联打开两个 socket, 面向客户端的绑定在控制连接的本地地址上,
+// 面向目的地址的由系统分配端口; 控制连接关闭时关联结束.
+//
+// 客户端必须在请求的 DST.PORT 中声明发送数据报所用的端口. 成功应答在 BND.PORT 之后
+// 附带 EXT.LEN (2) 与 EXT.DATA, EXT.DATA 为本关联随机生成的令牌, 客户端发出的每个
+// 数据报都以该令牌开头. 关联只接受控制连接所在地址上声明端口发来且令牌正确的数据报,
+// 令牌只经由已认证的控制连接下发, 同一主机或 NAT 后的其他进程无法冒充; 启用
+// -udp-any-port 时允许 DST.PORT 为 0, 由第一个令牌正确的数据报确定端口.
+// 目的地址只接受本关联发送过的地址的回包.
+//
+// 域名目的地址在后台解析, 解析完成前暂存少量数据报; 每个关联保留的目的地址数有上限,
+// 达到上限时先清理空闲的目的地址.
+//
+// 数据报格式 (RFC 1928 第 7 节), 不支持分片; 发往客户端的数据报没有 TOKEN:
+//
+// +-------+----+------+------+----------+----------+----------+
+// | TOKEN |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +-------+----+------+------+----------+----------+----------+
+// |  16   | 2  |  1   |  1   | Variable |    2     | Variable |
+// +-------+----+------+------+----------+----------+----------+
+
+const (
+	// udpHeaderRoom 回包在缓冲区开头预留的头部空间, 足够 IPv6 地址
+	udpHeaderRoom = 3 + 1 + 16 + 2
+
+	// maxUDPDests 每个关联保留的目的地址数
+	maxUDPDests = 256
+	// udpDestIdle 目的地址无数据往来超过该时间后可被清理
+	udpDestIdle = 2 * time.Minute
+	// maxPendingDatagrams 域名解析完成前每个目的地址最多暂存的数据报数
+	maxPendingDatagrams = 8
+	// udpTokenLen 关联令牌的长度
+	udpTokenLen = 16
+)
+
+var errFragmented = errors.New("fragmented datagram")
+
+// udpConfig UDP ASSOCIATE 的配置, 由命令行参数设置
+type udpConfig struct {
+	anyPort bool // 允许请求不声明客户端端口
+}
+
+var _udp = &udpConfig{}
+
+// udpDest 关联中的一个目的地址, 策略在第一次发送时检查; 字段受关联的锁保护
+type udpDest struct {
+	addr     netip.AddrPort
+	err      error
+	ready    bool     // 已完成策略检查与解析
+	pending  [][]byte // 解析完成前暂存的数据报
+	lastUsed time.Time
+}
+
+type udpAssociation struct {
+	principal *Principal
+	client    netip.AddrPort // 控制连接的客户端地址
+	local     *net.UDPConn   // 面向客户端
+	remote    *net.UDPConn   // 面向目的地址
+	acct      *relayAccount
+	ctx       context.Context // 关联结束时取消, 中止进行中的解析
+	token     [udpTokenLen]byte
+
+	mu    sync.Mutex
+	src   netip.AddrPort              // 已确定的客户端 UDP 地址
+	dests map[string]*udpDest         // DST.ADDR:DST.PORT -> 目的地址
+	peers map[netip.AddrPort]*udpDest // 发送过的目的地址, 只接受它们的回包
+}
+
+func handlerCmdUDPAssociate(cli net.Conn, req *ConnRequest, principal *Principal) error {
+	client, err := netip.ParseAddrPort(cli.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	ctrlLocal, err := netip.ParseAddrPort(cli.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	if req.Addr.Port == 0 && !_udp.anyPort {
+		log.Printf("拒绝 UDP ASSOCIATE: %v 未声明客户端端口", client)
+		cli.Write([]byte{Version, NotAllowed, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return errors.New("udp associate without client port")
+	}
+
+	local, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(ctrlLocal.Addr(), 0)))
+	if err != nil {
+		cli.Write([]byte{Version, GeneralFailure, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+	remote, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		local.Close()
+		cli.Write([]byte{Version, GeneralFailure, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := &udpAssociation{
+		principal: principal,
+		client:    netip.AddrPortFrom(client.Addr().Unmap(), client.Port()),
+		local:     local,
+		remote:    remote,
+		ctx:       ctx,
+		dests:     make(map[string]*udpDest),
+		peers:     make(map[netip.AddrPort]*udpDest),
+	}
+	if req.Addr.Port != 0 {
+		a.src = netip.AddrPortFrom(a.client.Addr(), req.Addr.Port)
+	}
+	if _, err := rand.Read(a.token[:]); err != nil {
+		local.Close()
+		remote.Close()
+		cli.Write([]byte{Version, GeneralFailure, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+	a.acct = _accounting.open(a.client.Addr().String(), "udp")
+
+	bnd := local.LocalAddr().(*net.UDPAddr).AddrPort()
+	reply := appendAddrPort([]byte{Version, Success, 0x00}, bnd)
+	reply = binary.BigEndian.AppendUint16(reply, udpTokenLen)
+	cli.Write(append(reply, a.token[:]...))
+	log.Printf("udp associate: %v, principal: %v, relay: %v, source: %v", a.client, principal, bnd, a.src)
+
+	metricUDPAssociations.With().Inc()
+	defer metricUDPAssociations.With().Add(-1)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.serveLocal()
+	}()
+	go func() {
+		defer wg.Done()
+		a.serveRemote()
+	}()
+
+	// 控制连接上不再有数据, 读到 EOF 或出错即结束关联
+	io.Copy(io.Discard, cli)
+	cancel()
+	local.Close()
+	remote.Close()
+	wg.Wait()
+	a.close()
+	return nil
+}
+
+// serveLocal 转发客户端发来的数据报
+func (a *udpAssociation) serveLocal() {
+	buf := bufpool.Get(bufpool.MaxSegmentSize)
+	defer bufpool.Put(buf)
+
+	for {
+		n, src, err := a.local.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !a.checkSource(netip.AddrPortFrom(src.Addr().Unmap(), src.Port()), buf[:n]) {
+			metricDatagramsDropped.With("source").Inc()
+			continue
+		}
+		host, port, payload, err := parseUDPHeader(buf[udpTokenLen:n])
+		if err != nil {
+			if errors.Is(err, errFragmented) {
+				metricDatagramsDropped.With("fragmented").Inc()
+			} else {
+				metricDatagramsDropped.With("malformed").Inc()
+			}
+			continue
+		}
+		a.send(host, port, payload)
+	}
+}
+
+// serveRemote 把目的地址的回包加上头部发给客户端, 头部直接写在缓冲区的预留空间中
+func (a *udpAssociation) serveRemote() {
+	buf := bufpool.Get(bufpool.MaxSegmentSize)
+	defer bufpool.Put(buf)
+
+	for {
+		n, from, err := a.remote.ReadFromUDPAddrPort(buf[udpHeaderRoom:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		a.mu.Lock()
+		d, src := a.peers[from], a.src
+		if d != nil {
+			d.lastUsed = time.Now()
+		}
+		a.mu.Unlock()
+		if d == nil || !src.IsValid() {
+			metricDatagramsDropped.With("unsolicited").Inc()
+			continue
+		}
+
+		hdr := appendAddrPort([]byte{0x00, 0x00, 0x00}, from)
+		start := udpHeaderRoom - len(hdr)
+		copy(buf[start:], hdr)
+		if _, err := a.local.WriteToUDPAddrPort(buf[start:udpHeaderRoom+n], src); err != nil {
+			continue
+		}
+		a.acct.add(0, n)
+		metricDatagrams.With("out").Inc()
+	}
+}
+
+// checkSource 只接受控制连接所在地址上已确定端口且以本关联令牌开头的数据报;
+// 未声明端口时 (-udp-any-port) 第一个令牌正确的数据报确定端口
+func (a *udpAssociation) checkSource(src netip.AddrPort, b []byte) bool {
+	if src.Addr() != a.client.Addr() || len(b) < udpTokenLen ||
+		subtle.ConstantTimeCompare(b[:udpTokenLen], a.token[:]) != 1 {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.src.IsValid() {
+		a.src = src
+	}
+	return a.src == src
+}
+
+// send 把载荷发往目的地址, 不等待域名解析
+func (a *udpAssociation) send(host string, port uint16, payload []byte) {
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	now := time.Now()
+	a.mu.Lock()
+	d, ok := a.dests[key]
+	if !ok {
+		if d = a.newDestLocked(key, host, port, now); d == nil {
+			a.mu.Unlock()
+			metricDatagramsDropped.With("dest_limit").Inc()
+			return
+		}
+	}
+	d.lastUsed = now
+	if !d.ready {
+		queued := len(d.pending) < maxPendingDatagrams
+		if queued {
+			d.pending = append(d.pending, bytes.Clone(payload))
+		}
+		a.mu.Unlock()
+		if !queued {
+			metricDatagramsDropped.With("pending").Inc()
+		}
+		return
+	}
+	addr, err := d.addr, d.err
+	a.mu.Unlock()
+	if err != nil {
+		dropUnsent(err, 1)
+		return
+	}
+	a.write(payload, addr)
+}
+
+// newDestLocked 登记目的地址: 按控制连接的 principal 检查策略, IP 直接使用,
+// 域名在后台解析. 目的地址数达到上限且没有可清理的空闲地址时返回 nil
+func (a *udpAssociation) newDestLocked(key, host string, port uint16, now time.Time) *udpDest {
+	if len(a.dests) >= maxUDPDests {
+		a.expireLocked(now)
+		if len(a.dests) >= maxUDPDests {
+			return nil
+		}
+	}
+	d := &udpDest{ready: true}
+	if d.err = _policy.allow(a.principal, host, port); d.err != nil {
+		log.Printf("拒绝 UDP 目的地址: %v", d.err)
+	} else if ip, err := netip.ParseAddr(host); err == nil {
+		d.addr = netip.AddrPortFrom(ip.Unmap(), port)
+		a.peers[d.addr] = d
+	} else {
+		d.ready = false
+		go a.resolve(key, d, host, port)
+	}
+	a.dests[key] = d
+	return d
+}
+
+// resolve 解析域名目的地址, 然后发出暂存的数据报
+func (a *udpAssociation) resolve(key string, d *udpDest, host string, port uint16) {
+	var addr netip.AddrPort
+	ips, err := net.DefaultResolver.LookupNetIP(a.ctx, "ip", host)
+	if err == nil {
+		addr = netip.AddrPortFrom(ips[0].Unmap(), port)
+	}
+
+	a.mu.Lock()
+	d.addr, d.err, d.ready = addr, err, true
+	pending := d.pending
+	d.pending = nil
+	if err == nil && a.dests[key] == d {
+		a.peers[addr] = d
+	}
+	a.mu.Unlock()
+
+	if err != nil {
+		dropUnsent(err, len(pending))
+		return
+	}
+	for _, p := range pending {
+		a.write(p, addr)
+	}
+}
+
+// expireLocked 清理空闲的目的地址
+func (a *udpAssociation) expireLocked(now time.Time) {
+	for key, d := range a.dests {
+		if d.ready && now.Sub(d.lastUsed) > udpDestIdle {
+			delete(a.dests, key)
+			if a.peers[d.addr] == d {
+				delete(a.peers, d.addr)
+			}
+		}
+	}
+}
+
+func (a *udpAssociation) write(payload []byte, addr netip.AddrPort) {
+	if _, err := a.remote.WriteToUDPAddrPort(payload, addr); err != nil {
+		return
+	}
+	a.acct.add(len(payload), 0)
+	metricDatagrams.With("in").Inc()
+}
+
+// dropUnsent 记录因策略拒绝或解析失败而丢弃的数据报
+func dropUnsent(err error, n int) {
+	if errors.Is(err, ErrNotAllowed) {
+		metricDatagramsDropped.With("denied").Add(float64(n))
+	} else {
+		metricDatagramsDropped.With("unresolved").Add(float64(n))
+	}
+}
+
+func (a *udpAssociation) close() {
+	client := a.client.Addr().String()
+	metricBytes.With(client, "in").Add(float64(a.acct.bytesIn.Load()))
+	metricBytes.With(client, "out").Add(float64(a.acct.bytesOut.Load()))
+	_accounting.close(a.acct)
+	log.Printf("udp associate closed: %v", a.client)
+}
+
+// parseUDPHeader 解析数据报头部, 返回目的地址与载荷
+func parseUDPHeader(b []byte) (host string, port uint16, payload []byte, err error) {
+	if len(b) < 4 {
+		return "", 0, nil, errors.New("short datagram")
+	}
+	if b[2] != 0x00 {
+		return "", 0, nil, errFragmented
+	}
+	b = b[3:]
+	var n int
+	switch b[0] {
+	case 0x01:
+		n = 1 + 4
+		if len(b) >= n {
+			host = netip.AddrFrom4([4]byte(b[1:n])).String()
+		}
+	case 0x04:
+		n = 1 + 16
+		if len(b) >= n {
+			host = netip.AddrFrom16([16]byte(b[1:n])).Unmap().String()
+		}
+	case 0x03:
+		if len(b) < 2 {
+			return "", 0, nil, errors.New("short datagram")
+		}
+		n = 2 + int(b[1])
+		if len(b) >= n {
+			host = string(b[2:n])
+		}
+	default:
+		return "", 0, nil, fmt.Errorf("unsupported address type %d", b[0])
+	}
+	if len(b) < n+2 || host == "" {
+		return "", 0, nil, errors.New("short datagram")
+	}
+	return host, binary.BigEndian.Uint16(b[n:]), b[n+2:], nil
+}
+
+// appendAddrPort 按 ATYP|ADDR|PORT 编码地址
+func appendAddrPort(b []byte, ap netip.AddrPort) []byte {
+	if ip := ap.Addr().Unmap(); ip.Is4() {
+		a := ip.As4()
+		b = append(append(b, 0x01), a[:]...)
+	} else {
+		a := ip.As16()
+		b = append(append(b, 0x04), a[:]...)
+	}
+	return binary.BigEndian.AppendUint16(b, ap.Port())
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// usePolicy 在测试期间以 data 替换全局授权策略
+func usePolicy(t *testing.T, data string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, data, time.Now())
+	p := &Policy{}
+	require.NoError(t, p.load(path))
+	old := _policy
+	_policy = p
+	t.Cleanup(func() { _policy = old })
+}
+
+// controlPair 建立一对回环 TCP 连接, 作为 SOCKS 控制连接的客户端与服务端
+func controlPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	server, err = ln.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// udpRecorder 把收到的数据报发到 channel
+func udpRecorder(t *testing.T) (*net.UDPConn, <-chan string) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	ch := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			ch <- string(buf[:n])
+			conn.WriteToUDPAddrPort([]byte("re:"+string(buf[:n])), from)
+		}
+	}()
+	return conn, ch
+}
+
+func udpDatagram(token []byte, dst netip.AddrPort, payload string) []byte {
+	b := append(append([]byte{}, token...), 0x00, 0x00, 0x00)
+	return append(appendAddrPort(b, dst), payload...)
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo, received := udpRecorder(t)
+	denied, deniedReceived := udpRecorder(t)
+	echoAddr := echo.LocalAddr().(*net.UDPAddr).AddrPort()
+	deniedAddr := denied.LocalAddr().(*net.UDPAddr).AddrPort()
+	usePolicy(t, fmt.Sprintf(`{"resources": {"dns": {"cidrs": ["127.0.0.0/8"], "ports": ["%d"]}}}`, echoAddr.Port()))
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer client.Close()
+	foreign, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer foreign.Close()
+
+	ctrl, srv := controlPair(t)
+	req := &ConnRequest{Cmd: 0x03, Addr: &Addr{Type: 0x01, Host: "0.0.0.0", Port: uint16(client.LocalAddr().(*net.UDPAddr).Port)}}
+	done := make(chan error, 1)
+	go func() { done <- handlerCmdUDPAssociate(srv, req, &Principal{Subject: "alice", ResID: "dns"}) }()
+
+	// VER REP RSV ATYP BND.ADDR(4) BND.PORT EXT.LEN TOKEN
+	reply := make([]byte, 3+1+4+2+2+udpTokenLen)
+	ctrl.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(ctrl, reply)
+	require.NoError(t, err)
+	require.Equal(t, []byte{Version, Success, 0x00, 0x01}, reply[:4])
+	require.Equal(t, []byte{0x00, udpTokenLen}, reply[10:12])
+	relay := netip.AddrPortFrom(netip.AddrFrom4([4]byte(reply[4:8])), uint16(reply[8])<<8|uint16(reply[9]))
+	token := reply[12:]
+
+	// 其他端口发来的数据报即使令牌正确也丢弃, 令牌错误的数据报同样丢弃
+	_, err = foreign.WriteToUDPAddrPort(udpDatagram(token, echoAddr, "foreign"), relay)
+	require.NoError(t, err)
+	_, err = client.WriteToUDPAddrPort(udpDatagram(make([]byte, udpTokenLen), echoAddr, "forged"), relay)
+	require.NoError(t, err)
+	// 策略不允许的目的地址
+	_, err = client.WriteToUDPAddrPort(udpDatagram(token, deniedAddr, "denied"), relay)
+	require.NoError(t, err)
+	_, err = client.WriteToUDPAddrPort(udpDatagram(token, echoAddr, "ping"), relay)
+	require.NoError(t, err)
+
+	select {
+	case got := <-received:
+		assert.Equal(t, "ping", got)
+	case <-time.After(time.Second):
+		t.Fatal("datagram not relayed")
+	}
+	buf := make([]byte, 1500)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	host, port, payload, err := parseUDPHeader(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, echoAddr, netip.AddrPortFrom(netip.MustParseAddr(host), port))
+	assert.Equal(t, "re:ping", string(payload))
+
+	select {
+	case got := <-received:
+		t.Errorf("unexpected datagram %q", got)
+	case got := <-deniedReceived:
+		t.Errorf("denied destination received %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// 控制连接关闭时关联结束, 中继 socket 随之关闭
+	ctrl.Close()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("association still open after the control connection closed")
+	}
+	relayConn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(relay))
+	require.NoError(t, err, "relay port still in use")
+	relayConn.Close()
+}
+
+func TestUDPAssociateRequiresPort(t *testing.T) {
+	ctrl, srv := controlPair(t)
+	req := &ConnRequest{Cmd: 0x03, Addr: &Addr{Type: 0x01, Host: "0.0.0.0"}}
+	done := make(chan error, 1)
+	go func() { done <- handlerCmdUDPAssociate(srv, req, &Principal{}) }()
+
+	reply := make([]byte, 10)
+	ctrl.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(ctrl, reply)
+	require.NoError(t, err)
+	assert.EqualValues(t, NotAllowed, reply[1])
+	assert.Error(t, <-done)
+}
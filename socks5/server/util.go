@@ -1,5 +1,12 @@
 package main
 
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
 // Command is request commands as defined in RFC 1928 section 4.
 type Command uint8
 
@@ -27,3 +34,35 @@ func (c Command) String() string {
 		return "UNDEFINED"
 	}
 }
+
+// writeFileAtomic 先写临时文件再改名, 避免进程崩溃时留下残缺的文件
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// countingWriter 把写入的字节数累加到每个计数器
+type countingWriter struct {
+	w io.Writer
+	n []*atomic.Uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	for _, counter := range c.n {
+		counter.Add(uint64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ares0516/tsuit/common"
+	"github.com/hashicorp/yamux"
+	"github.com/sirupsen/logrus"
+)
+
+// State 客户端连接状态
+type State int32
+
+const (
+	StateIdle State = iota
+	StateConnecting
+	StateConnected
+	StateBackoff
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backoff"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+type Client struct {
+	Server    string
+	Identity  string            // 客户端身份, 服务端据此分配固定的虚拟地址
+	Secret    []byte            // 与服务端共享的认证密钥
+	Caps      common.Capability // 希望启用的隧道能力
+	TLSConfig *tls.Config
+	Backoff   *common.Backoff
+
+	YamuxConfig *yamux.Config
+
+	// ShutdownTimeout 退出时等待进行中的流结束的最长时间
+	ShutdownTimeout time.Duration
+
+	// Forwards 本地端口转发, 经由隧道访问服务端网络
+	Forwards []common.LocalForward
+
+	// UDP 服务端发来的 UDP 会话的空闲时间与数据报长度限制
+	UDP common.UDPConfig
+
+	// OnStateChange 在状态切换时被调用, 不能阻塞
+	OnStateChange func(from, to State)
+
+	state   atomic.Int32
+	session atomic.Pointer[yamux.Session] // 当前会话, 协商了 CapForward 时才设置
+}
+
+func NewClient(server, identity string, secret []byte, tlsConfig *tls.Config) *Client {
+	return &Client{
+		Server:   server,
+		Identity: identity,
+		Secret:   secret,
+		Caps:     common.SupportedCaps &^ common.CapCompression,
+
+		ShutdownTimeout: 10 * time.Second,
+		TLSConfig:       tlsConfig,
+		Backoff:         common.NewBackoff(),
+	}
+}
+
+func (c *Client) State() State {
+	return State(c.state.Load())
+}
+
+func (c *Client) setState(s State) {
+	old := State(c.state.Swap(int32(s)))
+	if old == s {
+		return
+	}
+	logrus.WithFields(logrus.Fields{"from": old, "to": s}).Info("Client state changed")
+	if c.OnStateChange != nil {
+		c.OnStateChange(old, s)
+	}
+}
+
+// Run 保持与服务端的连接, 断开后按退避策略重连, 直到 ctx 被取消
+func (c *Client) Run(ctx context.Context) error {
+	defer c.setState(StateStopped)
+
+	if err := c.listenForwards(ctx); err != nil {
+		return err
+	}
+
+	for {
+		c.setState(StateConnecting)
+		established, err := c.serve(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if established {
+			c.Backoff.Reset()
+		}
+
+		wait := c.Backoff.Next()
+		logrus.Warnf("Connection to %s lost: %v, retry #%d in %v", c.Server, err, c.Backoff.Attempt(), wait)
+		c.setState(StateBackoff)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// serve 建立一次隧道并处理回连, 返回隧道是否曾建立成功
+func (c *Client) serve(ctx context.Context) (bool, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 10 * time.Second},
+		Config:    c.TLSConfig,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", c.Server)
+	if err != nil {
+		return false, err
+	}
+
+	// 握手阶段 ctx 取消时直接关闭底层连接, 打断阻塞中的读写
+	var closeOnce sync.Once
+	closeConn := func() { closeOnce.Do(func() { conn.Close() }) }
+	stopClose := context.AfterFunc(ctx, closeConn)
+	defer stopClose()
+	defer closeConn()
+
+	logrus.Infof("remote conn peer address: %s", conn.RemoteAddr().String())
+
+	hs, err := common.ClientHandshake(conn, c.Identity, c.Secret, c.Caps)
+	if err != nil {
+		logrus.Errorf("Handshake error: %v", err)
+		return false, err
+	}
+	logrus.Infof("Handshake success, version: %d, caps: %s", hs.Version, hs.Caps)
+
+	session, err := yamux.Client(common.WrapConn(conn, hs.Caps), c.YamuxConfig)
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+
+	// 会话建立后 ctx 取消时先排空再关闭
+	if !stopClose() {
+		return false, ctx.Err()
+	}
+	stopDrain := context.AfterFunc(ctx, func() { c.drain(session) })
+	defer stopDrain()
+
+	logrus.Infof("remote session peer address: %s", session.RemoteAddr().String())
+
+	if hs.Caps.Has(common.CapForward) {
+		c.session.Store(session)
+		defer c.session.CompareAndSwap(session, nil)
+	} else if len(c.Forwards) > 0 {
+		logrus.Warn("Server does not support forwarding, local forwards disabled")
+	}
+
+	socks5Server, err := common.NewSocksServer()
+	if err != nil {
+		return false, err
+	}
+
+	c.setState(StateConnected)
+	logrus.Info("Waiting for connections....")
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return true, ctx.Err()
+			}
+			return true, err
+		}
+		logrus.Info("New back connection")
+		go c.serveStream(stream, socks5Server, hs.Caps)
+	}
+}
+
+// serveStream 按流的第一个字节区分 UDP 会话与 SOCKS5 请求
+func (c *Client) serveStream(stream net.Conn, socks5Server *common.SocksServer, caps common.Capability) {
+	conn := common.NewPeekConn(stream)
+	b, err := conn.Peek()
+	if err != nil {
+		stream.Close()
+		return
+	}
+	if b != common.UDPStreamMagic || !caps.Has(common.CapUDP) {
+		socks5Server.ServeConn(conn)
+		return
+	}
+	defer stream.Close()
+	if err := common.ServeUDPStream(conn, c.UDP.MaxDatagramSize, c.UDP.IdleTimeout); err != nil {
+		logrus.Warnf("UDP stream from %s: %v", stream.RemoteAddr(), err)
+	}
+}
+
+// drain 拒绝服务端新开流, 等待进行中的流结束后关闭会话
+func (c *Client) drain(session *yamux.Session) {
+	session.GoAway()
+	logrus.Infof("Shutting down, draining %d streams", session.NumStreams())
+
+	deadline := time.Now().Add(c.ShutdownTimeout)
+	for session.NumStreams() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := session.NumStreams(); n > 0 {
+		logrus.Warnf("Drain timeout after %v, closing %d remaining streams", c.ShutdownTimeout, n)
+	}
+	session.Close()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ares0516/tsuit/common"
+	"github.com/hashicorp/yamux"
+)
+
+// selfSignedConfig 生成只用于测试的自签名证书
+func selfSignedConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}}}
+}
+
+// startTunnelServer 完成握手并建立会话; 第一个会话在 drop 关闭后断开,
+// 之后的会话保持到测试结束
+func startTunnelServer(t *testing.T, drop <-chan struct{}) string {
+	t.Helper()
+	secrets, err := common.NewStaticSecretStore([]common.ClientSecret{{Identity: "alice", Secret: "s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", selfSignedConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var sessions []*yamux.Session
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		ln.Close()
+		wg.Wait()
+		for _, s := range sessions {
+			s.Close()
+		}
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for first := true; ; first = false {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			hs, err := common.ServerHandshake(conn, secrets, common.SupportedCaps, nil)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			session, err := yamux.Server(common.WrapConn(conn, hs.Caps), nil)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			if !first {
+				sessions = append(sessions, session)
+				continue
+			}
+			select {
+			case <-drop:
+			case <-stop:
+			}
+			session.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestClientRunStates(t *testing.T) {
+	drop := make(chan struct{})
+	addr := startTunnelServer(t, drop)
+
+	c := NewClient(addr, "alice", []byte("s3cret"), &tls.Config{InsecureSkipVerify: true})
+	c.Backoff = &common.Backoff{Min: 10 * time.Millisecond, Max: 10 * time.Millisecond, Factor: 2}
+	c.ShutdownTimeout = time.Second
+
+	var mu sync.Mutex
+	var states []State
+	changed := make(chan State, 16)
+	c.OnStateChange = func(from, to State) {
+		mu.Lock()
+		states = append(states, to)
+		mu.Unlock()
+		changed <- to
+	}
+	waitFor := func(want State) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case s := <-changed:
+				if s == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for state %v, now %v", want, c.State())
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(StateConnected)
+	// 服务端断开后退避重连
+	close(drop)
+	waitFor(StateConnected)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []State{StateConnecting, StateConnected, StateBackoff, StateConnecting, StateConnected, StateStopped}
+	if len(states) != len(want) {
+		t.Fatalf("states %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states %v, want %v", states, want)
+		}
+	}
+	if c.State() != StateStopped {
+		t.Errorf("final state %v", c.State())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/ares0516/tsuit/common"
+	"github.com/sirupsen/logrus"
+)
+
+// listenForwards 为每条本地端口转发启动监听, ctx 取消后关闭
+func (c *Client) listenForwards(ctx context.Context) error {
+	var listeners []net.Listener
+	for _, f := range c.Forwards {
+		ln, err := net.Listen("tcp", f.Listen)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("forward %s: %v", f, err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	for i, ln := range listeners {
+		f := c.Forwards[i]
+		context.AfterFunc(ctx, func() { ln.Close() })
+		go func() {
+			logrus.Infof("Forward %s", f)
+			if err := common.Serve(ln, func(conn net.Conn) { c.handleForward(conn, f) }); err != nil {
+				logrus.Errorf("Forward %s stopped: %v", f, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// handleForward 经由当前会话打开一条流, 请求服务端连接 f 的目标
+func (c *Client) handleForward(conn net.Conn, f common.LocalForward) {
+	defer conn.Close()
+	session := c.session.Load()
+	if session == nil {
+		logrus.Warnf("Forward %s: tunnel not connected", f)
+		return
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		logrus.Errorf("Forward %s: open stream: %v", f, err)
+		return
+	}
+	defer stream.Close()
+
+	if err := common.Auth(stream); err != nil {
+		logrus.Errorf("Forward %s: %v", f, err)
+		return
+	}
+	if err := common.Requisition(stream, f.Host, f.Port, common.Connect); err != nil {
+		logrus.Warnf("Forward %s: server refused: %v", f, err)
+		return
+	}
+
+	go func() {
+		io.Copy(conn, stream)
+		conn.Close()
+	}()
+	io.Copy(stream, conn)
+}
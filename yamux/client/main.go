@@ -1,58 +1,142 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/ares0516/tsuit/common"
 	"github.com/sirupsen/logrus"
-
-	"github.com/hashicorp/yamux"
 )
 
-func Start(server string) error {
+func main() {
+	defaults := common.DefaultClientConfig()
+	configFile := flag.String("config", "", "The YAML configuration file")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and exit")
+	server := flag.String("server", defaults.Server, "The proxy server address)")
+	identity := flag.String("id", "", "The client identity, defaults to the certificate common name or the hostname")
+	secret := flag.String("secret", "", "The shared secret for tunnel authentication")
+	secretFile := flag.String("secret-file", "", "Read the shared secret from a file")
+	compress := flag.Bool("compress", false, "Request compression of tunnel traffic")
+	caFile := flag.String("ca", "", "The CA file used to verify the server certificate")
+	serverName := flag.String("server-name", "", "Override the server name used for certificate verification")
+	pins := flag.String("pin", "", "Comma separated SHA-256 pins of the server public key (sha256/BASE64 or hex)")
+	certFile := flag.String("cert", "", "The client certificate file for mutual TLS")
+	keyFile := flag.String("key", "", "The client private key file for mutual TLS")
+	insecure := flag.Bool("insecure", false, "Skip server certificate verification (testing only)")
+	logLevel := flag.String("log-level", "", "The log level (debug, info, warn, error)")
+	var forwards forwardFlags
+	flag.Var(&forwards, "L", "Local forward LISTEN=HOST:PORT through the server, may be repeated (e.g. 127.0.0.1:15432=db.internal:5432)")
+	flag.Parse()
 
-	config := &tls.Config{InsecureSkipVerify: true}
-	conn, err := tls.Dial("tcp", server, config)
-	if err != nil {
-		return err
+	cfg := defaults
+	if *configFile != "" {
+		var err error
+		if cfg, err = common.LoadClientConfig(*configFile); err != nil {
+			exitConfigError(err)
+		}
 	}
 
-	logrus.Info("remote conn peer address: %s", conn.RemoteAddr().String())
+	// 命令行参数覆盖配置文件
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server":
+			cfg.Server = *server
+		case "id":
+			cfg.Identity = *identity
+		case "secret":
+			cfg.Secret, cfg.SecretFile = *secret, ""
+		case "secret-file":
+			cfg.Secret, cfg.SecretFile = "", *secretFile
+		case "compress":
+			cfg.Compress = *compress
+		case "ca":
+			cfg.TLS.CA = *caFile
+		case "server-name":
+			cfg.TLS.ServerName = *serverName
+		case "pin":
+			cfg.TLS.Pins = strings.Split(*pins, ",")
+		case "cert":
+			cfg.TLS.Cert = *certFile
+		case "key":
+			cfg.TLS.Key = *keyFile
+		case "insecure":
+			cfg.TLS.Insecure = *insecure
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "L":
+			cfg.Forwards = forwards
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		exitConfigError(err)
+	}
+	if *checkConfig {
+		fmt.Println("configuration OK")
+		return
+	}
+	cfg.Log.Apply()
 
-	err = common.PipeAuth(conn)
+	tlsConfig, err := common.ClientTLSConfig(cfg.TLS.Options())
 	if err != nil {
-		logrus.Errorf("PipeAuth error: %v", err)
-	} else {
-		logrus.Info("PipeAuth success")
+		logrus.Fatalf("TLS 配置错误: %v", err)
 	}
 
-	session, err := yamux.Client(conn, nil)
-	if err != nil {
-		return err
+	id := cfg.Identity
+	if id == "" && cfg.TLS.Cert != "" {
+		if id, err = common.CertIdentity(cfg.TLS.Cert); err != nil {
+			logrus.Fatalf("读取证书失败: %v", err)
+		}
+	}
+	if id == "" {
+		id, _ = os.Hostname()
 	}
 
-	logrus.Info("remote session peer address: %s", session.RemoteAddr().String())
+	key, err := cfg.LoadSecret()
+	if err != nil {
+		logrus.Fatalf("读取密钥文件失败: %v", err)
+	}
 
-	logrus.Info("Waiting for connections....")
+	client := NewClient(cfg.Server, id, key, tlsConfig)
+	if cfg.Compress {
+		client.Caps |= common.CapCompression
+	}
+	client.YamuxConfig = cfg.Yamux.Config()
+	client.Backoff.Min = cfg.Reconnect.MinDelay
+	client.Backoff.Max = cfg.Reconnect.MaxDelay
+	client.ShutdownTimeout = cfg.ShutdownTimeout
+	client.Forwards = cfg.ParsedForwards()
+	client.UDP = cfg.UDP
 
-	socks5Server, err := common.NewSimpleSocksProxyServer()
-	if err != nil {
-		logrus.Errorf("NewSimpleSocksProxyServer error: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := client.Run(ctx); err != nil && ctx.Err() == nil {
+		logrus.Fatalf("%v", err)
 	}
+	logrus.Info("Client stopped")
+}
 
-	for {
-		stream, err := session.Accept()
-		if err != nil {
-			return err
-		}
-		logrus.Info("New back connection")
-		go socks5Server.ServeConn(stream)
+// forwardFlags 支持重复指定 -L
+type forwardFlags []string
+
+func (f *forwardFlags) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *forwardFlags) Set(value string) error {
+	if _, err := common.ParseLocalForward(value); err != nil {
+		return err
 	}
+	*f = append(*f, value)
+	return nil
 }
 
-func main() {
-	server := flag.String("server", "192.168.31.142:1080", "The proxy server address)")
-	flag.Parse()
-	Start(*server)
+// exitConfigError 逐行输出配置错误后退出
+func exitConfigError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
 }
@@ -0,0 +1,248 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Usage 按客户端身份、虚拟地址与目的地址汇总的流量,
+// BytesIn 为从客户端收到的字节数, BytesOut 为发往客户端的字节数
+type Usage struct {
+	Identity  string        `json:"identity"`
+	VIP       string        `json:"vip"`
+	Dest      string        `json:"dest"`
+	Streams   uint64        `json:"streams"`
+	BytesIn   uint64        `json:"bytes_in"`
+	BytesOut  uint64        `json:"bytes_out"`
+	Duration  time.Duration `json:"duration"` // 已结束的流的累计时长
+	FirstSeen time.Time     `json:"first_seen"`
+	LastSeen  time.Time     `json:"last_seen"`
+}
+
+type usageKey struct {
+	identity, vip, dest string
+}
+
+// usageEntry 的字节计数在转发过程中原子累加, 其余字段受 Accounting 的锁保护
+type usageEntry struct {
+	Usage
+	bytesIn, bytesOut atomic.Uint64
+}
+
+func (e *usageEntry) snapshot() Usage {
+	u := e.Usage
+	u.BytesIn += e.bytesIn.Load()
+	u.BytesOut += e.bytesOut.Load()
+	return u
+}
+
+// Accounting 统计每条转发流的流量与时长, 汇总结果可实时查询,
+// 并定期写入本地文件, 重启后在原有基础上继续累加
+type Accounting struct {
+	mu     sync.Mutex
+	path   string
+	usage  map[usageKey]*usageEntry
+	active map[*StreamAccount]struct{}
+}
+
+// NewAccounting 返回只保存在内存中的统计
+func NewAccounting() *Accounting {
+	return &Accounting{
+		usage:  make(map[usageKey]*usageEntry),
+		active: make(map[*StreamAccount]struct{}),
+	}
+}
+
+// LoadAccounting 从 path 加载历史汇总, path 为空时只保存在内存中
+func LoadAccounting(path string) (*Accounting, error) {
+	a := NewAccounting()
+	a.path = path
+	if path == "" {
+		return a, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var usage []Usage
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, err
+	}
+	for _, u := range usage {
+		a.usage[usageKey{u.Identity, u.VIP, u.Dest}] = &usageEntry{Usage: u}
+	}
+	return a, nil
+}
+
+// StreamAccount 单条流的计数器
+type StreamAccount struct {
+	Identity string
+	VIP      string
+	Dest     string
+	Start    time.Time
+
+	acct              *Accounting
+	entry             *usageEntry
+	bytesIn, bytesOut atomic.Uint64
+	closed            atomic.Bool
+}
+
+// StreamUsage 进行中的流的实时流量
+type StreamUsage struct {
+	Identity string        `json:"identity"`
+	VIP      string        `json:"vip"`
+	Dest     string        `json:"dest"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	BytesIn  uint64        `json:"bytes_in"`
+	BytesOut uint64        `json:"bytes_out"`
+}
+
+// Open 开始统计一条流, 结束时必须调用 Close
+func (a *Accounting) Open(identity, vip, dest string) *StreamAccount {
+	now := time.Now()
+	key := usageKey{identity, vip, dest}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.usage[key]
+	if !ok {
+		entry = &usageEntry{Usage: Usage{Identity: identity, VIP: vip, Dest: dest, FirstSeen: now}}
+		a.usage[key] = entry
+	}
+	entry.Streams++
+	entry.LastSeen = now
+
+	s := &StreamAccount{Identity: identity, VIP: vip, Dest: dest, Start: now, acct: a, entry: entry}
+	a.active[s] = struct{}{}
+	return s
+}
+
+// CountIn 包装写入从客户端收到的数据的 Writer
+func (s *StreamAccount) CountIn(w io.Writer) io.Writer {
+	return &countingWriter{w: w, n: []*atomic.Uint64{&s.bytesIn, &s.entry.bytesIn}}
+}
+
+// CountOut 包装写入发往客户端的数据的 Writer
+func (s *StreamAccount) CountOut(w io.Writer) io.Writer {
+	return &countingWriter{w: w, n: []*atomic.Uint64{&s.bytesOut, &s.entry.bytesOut}}
+}
+
+// Close 结束统计, 把时长计入汇总; 可重复调用
+func (s *StreamAccount) Close() {
+	if s.closed.Swap(true) {
+		return
+	}
+	d := time.Since(s.Start)
+	a := s.acct
+	a.mu.Lock()
+	delete(a.active, s)
+	s.entry.Duration += d
+	s.entry.LastSeen = time.Now()
+	a.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"identity":  s.Identity,
+		"vip":       s.VIP,
+		"dest":      s.Dest,
+		"duration":  d.Round(time.Millisecond),
+		"bytes_in":  s.bytesIn.Load(),
+		"bytes_out": s.bytesOut.Load(),
+	}).Debug("Stream closed")
+}
+
+func (s *StreamAccount) usage() StreamUsage {
+	return StreamUsage{
+		Identity: s.Identity,
+		VIP:      s.VIP,
+		Dest:     s.Dest,
+		Start:    s.Start,
+		Duration: time.Since(s.Start),
+		BytesIn:  s.bytesIn.Load(),
+		BytesOut: s.bytesOut.Load(),
+	}
+}
+
+// Usage 返回汇总流量, 包含进行中的流已经转发的字节;
+// identity 非空时只返回该客户端的记录
+func (a *Accounting) Usage(identity string) []Usage {
+	a.mu.Lock()
+	usage := make([]Usage, 0, len(a.usage))
+	for _, e := range a.usage {
+		if identity == "" || e.Identity == identity {
+			usage = append(usage, e.snapshot())
+		}
+	}
+	a.mu.Unlock()
+
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Identity != usage[j].Identity {
+			return usage[i].Identity < usage[j].Identity
+		}
+		if usage[i].VIP != usage[j].VIP {
+			return usage[i].VIP < usage[j].VIP
+		}
+		return usage[i].Dest < usage[j].Dest
+	})
+	return usage
+}
+
+// Active 返回进行中的流, 按开始时间排序
+func (a *Accounting) Active() []StreamUsage {
+	a.mu.Lock()
+	streams := make([]StreamUsage, 0, len(a.active))
+	for s := range a.active {
+		streams = append(streams, s.usage())
+	}
+	a.mu.Unlock()
+
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Start.Before(streams[j].Start) })
+	return streams
+}
+
+// Run 每隔 interval 把汇总写入文件, ctx 取消时最后写入一次
+func (a *Accounting) Run(ctx context.Context, interval time.Duration) {
+	if a.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := a.Flush(); err != nil {
+				logrus.Errorf("写入流量统计失败: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := a.Flush(); err != nil {
+				logrus.Errorf("写入流量统计失败: %v", err)
+			}
+		}
+	}
+}
+
+// Flush 把汇总写回统计文件
+func (a *Accounting) Flush() error {
+	if a.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(a.Usage(""), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.path, data)
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccountingCountsAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	a, err := LoadAccounting(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := a.Open("alice", "10.0.0.1", "127.0.0.1:22")
+	var toServer, toClient bytes.Buffer
+	io.Copy(s.CountIn(&toServer), strings.NewReader("hello"))
+	io.Copy(s.CountOut(&toClient), strings.NewReader("hi"))
+
+	if active := a.Active(); len(active) != 1 || active[0].BytesIn != 5 || active[0].BytesOut != 2 {
+		t.Fatalf("active = %+v, want one stream with 5/2 bytes", active)
+	}
+	if usage := a.Usage("alice"); len(usage) != 1 || usage[0].BytesIn != 5 {
+		t.Fatalf("usage before close = %+v, want live bytes included", usage)
+	}
+	s.Close()
+	s.Close()
+	if len(a.Active()) != 0 {
+		t.Error("closed stream still active")
+	}
+
+	a.Open("alice", "10.0.0.1", "127.0.0.1:22").Close()
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := LoadAccounting(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := b.Usage("")
+	if len(usage) != 1 {
+		t.Fatalf("reloaded %d records, want 1", len(usage))
+	}
+	if u := usage[0]; u.Streams != 2 || u.BytesIn != 5 || u.BytesOut != 2 || u.Duration <= 0 {
+		t.Errorf("reloaded usage = %+v", u)
+	}
+	if len(b.Usage("bob")) != 0 {
+		t.Error("identity filter returned foreign records")
+	}
+}
@@ -0,0 +1,158 @@
+package common
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// TargetRule 允许访问的目标, 写法为 HOST[:PORT]:
+//
+//	10.1.0.0/16           网段内任意端口
+//	192.168.1.10:22       单个地址与端口
+//	db.internal:5432      域名
+//	*.corp.example:443    域名后缀
+//	[fd00::/8]:1000-2000  IPv6 网段与端口范围
+//	*:443                 任意主机
+type TargetRule struct {
+	Prefix  netip.Prefix // 为空时按 Host 匹配
+	Host    string       // 小写域名, "*." 开头表示后缀, "*" 表示任意主机
+	PortMin uint16
+	PortMax uint16
+}
+
+func ParseTargetRule(s string) (TargetRule, error) {
+	host, ports := s, ""
+	switch {
+	case strings.HasPrefix(s, "["):
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return TargetRule{}, fmt.Errorf("invalid target %q: missing ']'", s)
+		}
+		host, ports = s[1:end], strings.TrimPrefix(s[end+1:], ":")
+	case strings.Count(s, ":") == 1:
+		host, ports, _ = strings.Cut(s, ":")
+	}
+
+	r := TargetRule{PortMin: 1, PortMax: 65535}
+	if ports != "" && ports != "*" {
+		lo, hi, isRange := strings.Cut(ports, "-")
+		min, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil || min == 0 {
+			return TargetRule{}, fmt.Errorf("invalid port %q in %q", ports, s)
+		}
+		max := min
+		if isRange {
+			if max, err = strconv.ParseUint(hi, 10, 16); err != nil || max < min {
+				return TargetRule{}, fmt.Errorf("invalid port %q in %q", ports, s)
+			}
+		}
+		r.PortMin, r.PortMax = uint16(min), uint16(max)
+	}
+
+	if host == "" {
+		return TargetRule{}, fmt.Errorf("invalid target %q: missing host", s)
+	}
+	if host == "*" || strings.HasPrefix(host, "*.") {
+		r.Host = strings.ToLower(host)
+		return r, nil
+	}
+	if prefix, err := parsePrefix(host); err == nil {
+		r.Prefix = prefix.Masked()
+		return r, nil
+	}
+	if strings.ContainsAny(host, "/*") {
+		return TargetRule{}, fmt.Errorf("invalid host %q in %q", host, s)
+	}
+	r.Host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return r, nil
+}
+
+func (r TargetRule) String() string {
+	host := r.Host
+	if r.Prefix.IsValid() {
+		host = r.Prefix.String()
+		if r.Prefix.IsSingleIP() {
+			host = r.Prefix.Addr().String()
+		}
+		if r.Prefix.Addr().Is6() {
+			host = "[" + host + "]"
+		}
+	}
+	switch {
+	case r.PortMin == 1 && r.PortMax == 65535:
+		return host
+	case r.PortMin == r.PortMax:
+		return fmt.Sprintf("%s:%d", host, r.PortMin)
+	default:
+		return fmt.Sprintf("%s:%d-%d", host, r.PortMin, r.PortMax)
+	}
+}
+
+// Match 判断目标是否匹配, host 为请求中的域名 (可为空), ip 为解析后的地址
+func (r TargetRule) Match(host string, ip netip.Addr, port uint16) bool {
+	if port < r.PortMin || port > r.PortMax {
+		return false
+	}
+	if r.Prefix.IsValid() {
+		return ip.IsValid() && r.Prefix.Contains(ip.Unmap())
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case r.Host == "*":
+		return true
+	case strings.HasPrefix(r.Host, "*."):
+		return strings.HasSuffix(host, r.Host[1:])
+	default:
+		return host == r.Host
+	}
+}
+
+// TargetACL 按客户端身份限制可访问的目标, 没有单独配置的客户端使用默认规则;
+// 规则为空表示全部拒绝
+type TargetACL struct {
+	defaults []TargetRule
+	clients  map[string][]TargetRule
+}
+
+// NewTargetACL 解析默认规则与按身份配置的规则
+func NewTargetACL(defaults []string, clients map[string][]string) (*TargetACL, error) {
+	acl := &TargetACL{clients: make(map[string][]TargetRule, len(clients))}
+	var err error
+	if acl.defaults, err = parseTargetRules(defaults); err != nil {
+		return nil, err
+	}
+	for identity, rules := range clients {
+		if acl.clients[identity], err = parseTargetRules(rules); err != nil {
+			return nil, fmt.Errorf("%s: %v", identity, err)
+		}
+	}
+	return acl, nil
+}
+
+func parseTargetRules(rules []string) ([]TargetRule, error) {
+	out := make([]TargetRule, 0, len(rules))
+	for _, s := range rules {
+		r, err := ParseTargetRule(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// Allow 判断 identity 是否可以访问目标
+func (a *TargetACL) Allow(identity, host string, ip netip.Addr, port uint16) bool {
+	rules, ok := a.clients[identity]
+	if !ok {
+		rules = a.defaults
+	}
+	for _, r := range rules {
+		if r.Match(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
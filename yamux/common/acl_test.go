@@ -0,0 +1,67 @@
+package common
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseTargetRule(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"10.1.0.0/16", "10.1.0.0/16"},
+		{"192.168.1.10:22", "192.168.1.10:22"},
+		{"DB.internal:5432", "db.internal:5432"},
+		{"*.corp.example:443", "*.corp.example:443"},
+		{"[fd00::/8]:1000-2000", "[fd00::/8]:1000-2000"},
+		{"*:*", "*"},
+		{"2001:db8::1", "[2001:db8::1]"},
+	} {
+		r, err := ParseTargetRule(tc.in)
+		if err != nil {
+			t.Errorf("ParseTargetRule(%q): %v", tc.in, err)
+			continue
+		}
+		if got := r.String(); got != tc.want {
+			t.Errorf("ParseTargetRule(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"", ":22", "10.0.0.1:0", "host:2-1", "[::1", "a/b:1", "host:x"} {
+		if _, err := ParseTargetRule(bad); err == nil {
+			t.Errorf("ParseTargetRule(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestTargetACL(t *testing.T) {
+	acl, err := NewTargetACL([]string{"*.public.example:443"}, map[string][]string{
+		"alice": {"10.1.0.0/16", "db.internal:5432"},
+		"bob":   {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := netip.MustParseAddr
+	for _, tc := range []struct {
+		identity, host string
+		ip             netip.Addr
+		port           uint16
+		want           bool
+	}{
+		{"alice", "", ip("10.1.2.3"), 80, true},
+		{"alice", "", ip("::ffff:10.1.2.3"), 80, true},
+		{"alice", "", ip("10.2.0.1"), 80, false},
+		{"alice", "db.internal.", ip("10.9.9.9"), 5432, true},
+		{"alice", "db.internal", netip.Addr{}, 5433, false},
+		{"alice", "www.public.example", netip.Addr{}, 443, false},
+		{"carol", "www.public.example", netip.Addr{}, 443, true},
+		{"carol", "public.example", netip.Addr{}, 443, false},
+		{"bob", "www.public.example", netip.Addr{}, 443, false},
+	} {
+		if got := acl.Allow(tc.identity, tc.host, tc.ip, tc.port); got != tc.want {
+			t.Errorf("Allow(%s, %q, %v, %d) = %v, want %v", tc.identity, tc.host, tc.ip, tc.port, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// SOCKS5 UDP 请求头 (RFC 1928 第 7 节):
+//
+//	| RSV (2) | FRAG (1) | ATYP (1) | DST.ADDR | DST.PORT (2) | DATA |
+//
+// 不支持分片, FRAG 不为 0 的数据报直接丢弃.
+const maxUDPHeaderLen = 3 + 1 + 1 + 255 + 2
+
+// SocksPacketConn 经由 SOCKS5 UDP ASSOCIATE 收发数据报, 实现 net.PacketConn;
+// 代理关闭控制连接时关联结束, 之后的读写返回 net.ErrClosed.
+// 客户端内置的 SOCKS 服务见 SocksServer.
+type SocksPacketConn struct {
+	ctrl  net.Conn     // 关联存续期间保持的 TCP 控制连接
+	conn  *net.UDPConn // 本地 socket, 只接收来自中继的数据报
+	relay netip.AddrPort
+
+	rmu  sync.Mutex
+	rbuf []byte
+
+	closeOnce sync.Once
+}
+
+// ListenPacket 建立 UDP 关联, ctx 只限制建立过程. network 只用于检查参数,
+// 本地 socket 的地址族与代理地址一致, 代理给出的中继地址须属于同一地址族
+func (d *SocksDialer) ListenPacket(ctx context.Context, network string) (*SocksPacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: fmt.Errorf("socks5: unsupported network %q", network)}
+	}
+	ctrl, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 先打开本地 socket, 在请求中声明发送数据报所用的地址与端口; 代理可能只接受
+	// 来自声明端口的数据报
+	var local, proxy netip.AddrPort
+	if a, ok := ctrl.LocalAddr().(*net.TCPAddr); ok {
+		local = a.AddrPort()
+	}
+	if a, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+		proxy = a.AddrPort()
+	}
+	udpNet := "udp"
+	if proxy.IsValid() {
+		udpNet = udpNetwork(proxy.Addr())
+	}
+	conn, err := net.ListenUDP(udpNet, nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	declared := netip.IPv4Unspecified()
+	if local.IsValid() {
+		declared = local.Addr().Unmap()
+	}
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	var bnd SocksAddr
+	if err := d.handshake(ctx, ctrl, func() (err error) {
+		bnd, err = Request(ctrl, UDP, declared.String(), port)
+		return err
+	}); err != nil {
+		conn.Close()
+		ctrl.Close()
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	relay, err := relayAddr(bnd, proxy)
+	if err == nil && proxy.IsValid() && udpNetwork(relay.Addr()) != udpNet {
+		err = fmt.Errorf("socks5: relay %v and proxy %v are in different address families", relay, proxy)
+	}
+	if err != nil {
+		conn.Close()
+		ctrl.Close()
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	c := &SocksPacketConn{
+		ctrl:  ctrl,
+		conn:  conn,
+		relay: relay,
+		rbuf:  make([]byte, maxUDPHeaderLen+MaxDatagramSize),
+	}
+	go func() {
+		// 控制连接上不再有数据往来, 读到 EOF 即关联结束
+		io.Copy(io.Discard, ctrl)
+		c.Close()
+	}()
+	return c, nil
+}
+
+// udpNetwork 按地址族选择 "udp4" 或 "udp6"
+func udpNetwork(ip netip.Addr) string {
+	if ip.Unmap().Is4() {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// relayAddr BND.ADDR 为全零地址时, 中继与代理服务器在同一地址上
+func relayAddr(bnd SocksAddr, proxy netip.AddrPort) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(bnd.Host)
+	if err != nil {
+		a, err := net.ResolveUDPAddr("udp", bnd.String())
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		return unmapAddrPort(a.AddrPort()), nil
+	}
+	if ip.IsUnspecified() && proxy.IsValid() {
+		ip = proxy.Addr()
+	}
+	return netip.AddrPortFrom(ip.Unmap(), bnd.Port), nil
+}
+
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// RelayAddr 代理分配的 UDP 中继地址
+func (c *SocksPacketConn) RelayAddr() net.Addr { return net.UDPAddrFromAddrPort(c.relay) }
+
+// WriteTo 把 p 封装为一个 SOCKS5 UDP 数据报发往 addr, addr 可以是 *net.UDPAddr 或 SocksAddr
+func (c *SocksPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	var host string
+	var port uint16
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ap := a.AddrPort()
+		host, port = ap.Addr().Unmap().String(), ap.Port()
+	case SocksAddr:
+		host, port = a.Host, a.Port
+	default:
+		var err error
+		if host, port, err = splitHostPort(addr.String()); err != nil {
+			return 0, &net.OpError{Op: "write", Net: "socks5", Addr: addr, Err: err}
+		}
+	}
+	if len(p) > MaxDatagramSize {
+		return 0, &net.OpError{Op: "write", Net: "socks5", Addr: addr, Err: ErrDatagramTooLarge}
+	}
+	b, err := appendAddr(make([]byte, 3, maxUDPHeaderLen+len(p)), host, port)
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "socks5", Addr: addr, Err: err}
+	}
+	if _, err := c.conn.WriteToUDPAddrPort(append(b, p...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom 读取一个数据报, 返回去掉 SOCKS5 头的载荷与其来源; p 不足时截断,
+// 与 net.UDPConn 相同. 来源为 IP 时返回 *net.UDPAddr, 否则返回 SocksAddr
+func (c *SocksPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		n, from, err := c.conn.ReadFromUDPAddrPort(c.rbuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// 不是来自中继, 以及分片或格式错误的数据报丢弃
+		if unmapAddrPort(from) != c.relay || n < 4 || c.rbuf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(c.rbuf[3:n])
+		host, port, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		var src net.Addr = SocksAddr{Host: host, Port: port}
+		if ip, err := netip.ParseAddr(host); err == nil {
+			src = net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port))
+		}
+		return copy(p, c.rbuf[n-r.Len():n]), src, nil
+	}
+}
+
+// Close 关闭本地 socket 与控制连接, 代理随之释放关联
+func (c *SocksPacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+		c.ctrl.Close()
+	})
+	return err
+}
+
+func (c *SocksPacketConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *SocksPacketConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *SocksPacketConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *SocksPacketConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+var _ net.PacketConn = (*SocksPacketConn)(nil)
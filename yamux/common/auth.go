@@ -1,68 +1,131 @@
 package common
 
 import (
-	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 )
 
-var token = []byte("in the pipe, five by five")
+// 隧道认证流程 (长度字段均为 2 字节大端), 在版本协商之后进行,
+// 认证结果随握手结果一并返回, 见 hello.go:
+//
+//	client -> server: | ID_LEN | IDENTITY |
+//	server -> client: | NONCE (32) |
+//	client -> server: | MAC (32) |       MAC = HMAC-SHA256(secret, NONCE || IDENTITY)
+const (
+	NonceSize      = 32
+	MaxIdentityLen = 4096
 
-func PipeAuth(conn net.Conn) error {
-	auth := &bytes.Buffer{}
-	len := len(token)
-	auth.WriteByte(byte(len))
-	auth.Write(token)
+	// HandshakeTimeout 认证阶段的读写超时
+	HandshakeTimeout = 10 * time.Second
+)
 
-	// 发送认证数据
-	_, err := conn.Write(auth.Bytes())
-	if err != nil {
-		return err
+var (
+	ErrAuthFailed      = errors.New("auth failed")
+	ErrUnknownIdentity = errors.New("unknown identity")
+	ErrRevoked         = errors.New("identity revoked")
+)
+
+// SecretLookup 按客户端身份查找共享密钥
+type SecretLookup interface {
+	Secret(identity string) ([]byte, error)
+}
+
+// PipeAuth 客户端使用身份与密钥完成挑战应答
+func PipeAuth(conn net.Conn, identity string, secret []byte) error {
+	if identity == "" || len(identity) > MaxIdentityLen {
+		return fmt.Errorf("invalid identity length %d", len(identity))
 	}
 
-	// 读取响应
-	response := make([]byte, 4)
-	if _, err := io.ReadFull(conn, response); err != nil {
+	// 发送身份
+	if err := writeFrame(conn, []byte(identity)); err != nil {
 		return err
 	}
 
-	// 检查响应
-	if string(response) == "succ" {
-		return nil
+	// 读取挑战
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return err
 	}
-	return fmt.Errorf("auth failed: %s", response)
+
+	// 发送应答
+	_, err := conn.Write(computeMAC(secret, nonce, identity))
+	return err
 }
 
-func PipeCheck(conn net.Conn) error {
-	// 读取token长度 (1字节)
-	lenBuf := make([]byte, 1)
-	if _, err := io.ReadFull(conn, lenBuf); err != nil {
-		return err
+// PipeCheck 服务端校验挑战应答, 成功时返回客户端身份;
+// 认证失败时返回 RejectError, 由调用方把结果发给客户端
+func PipeCheck(conn net.Conn, secrets SecretLookup) (string, error) {
+	// 读取身份
+	idBuf, err := readFrame(conn, MaxIdentityLen)
+	if err != nil {
+		return "", err
 	}
+	identity := string(idBuf)
 
-	// 获取token长度
-	tokenLen := int(lenBuf[0])
+	// 发送挑战, 未知身份同样下发挑战, 避免暴露身份是否存在
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return "", err
+	}
 
-	// 读取token内容
-	recvToken := make([]byte, tokenLen)
-	if _, err := io.ReadFull(conn, recvToken); err != nil {
-		return err
+	// 读取应答
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, mac); err != nil {
+		return "", err
 	}
 
-	// 验证token是否匹配
-	if !bytes.Equal(recvToken, token) {
-		// 发送失败响应
-		if _, err := conn.Write([]byte("fail")); err != nil {
-			return err
+	secret, lookupErr := secrets.Secret(identity)
+	if lookupErr == nil && len(identity) == 0 {
+		lookupErr = ErrUnknownIdentity
+	}
+	if lookupErr != nil || !hmac.Equal(mac, computeMAC(secret, nonce, identity)) {
+		// 未知身份, 已吊销的身份与密钥错误对客户端不做区分, 吊销只体现在服务端的错误中
+		reject := &RejectError{Code: RejectAuth, Message: identity}
+		if errors.Is(lookupErr, ErrRevoked) {
+			return "", fmt.Errorf("%w: %w", reject, ErrRevoked)
 		}
-		return errors.New("token mismatch")
+		return "", reject
 	}
+	return identity, nil
+}
 
-	// 发送成功响应
-	if _, err := conn.Write([]byte("succ")); err != nil {
-		return err
+func computeMAC(secret, nonce []byte, identity string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(nonce)
+	h.Write([]byte(identity))
+	return h.Sum(nil)
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader, max int) ([]byte, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(lenBuf))
+	if n > max {
+		return nil, fmt.Errorf("frame too large: %d > %d", n, max)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
 	}
-	return nil
+	return data, nil
 }
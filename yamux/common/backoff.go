@@ -0,0 +1,56 @@
+package common
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff 带抖动的指数退避
+type Backoff struct {
+	Min    time.Duration // 首次等待时间
+	Max    time.Duration // 等待时间上限
+	Factor float64       // 每次失败后的增长倍数
+	Jitter float64       // 抖动比例, 0~1
+
+	attempt int
+}
+
+func NewBackoff() *Backoff {
+	return &Backoff{
+		Min:    500 * time.Millisecond,
+		Max:    30 * time.Second,
+		Factor: 2,
+		Jitter: 0.2,
+	}
+}
+
+// Next 返回下一次重试前的等待时间
+func (b *Backoff) Next() time.Duration {
+	d := float64(b.Min)
+	for i := 0; i < b.attempt && d < float64(b.Max); i++ {
+		d *= b.Factor
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	b.attempt++
+
+	if b.Jitter > 0 {
+		delta := d * b.Jitter
+		d = d - delta + rand.Float64()*2*delta
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// Reset 连接成功后重置退避计数
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// Attempt 返回连续失败次数
+func (b *Backoff) Attempt() int {
+	return b.attempt
+}
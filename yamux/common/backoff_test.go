@@ -0,0 +1,58 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowth(t *testing.T) {
+	b := &Backoff{Min: 100 * time.Millisecond, Max: time.Second, Factor: 2}
+	for i, want := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second, // 达到上限
+		time.Second,
+	} {
+		if d := b.Next(); d != want {
+			t.Errorf("attempt %d: waited %v, want %v", i, d, want)
+		}
+		if b.Attempt() != i+1 {
+			t.Errorf("attempt %d: Attempt() = %d", i, b.Attempt())
+		}
+	}
+
+	b.Reset()
+	if b.Attempt() != 0 {
+		t.Errorf("Attempt() after reset = %d", b.Attempt())
+	}
+	if d := b.Next(); d != 100*time.Millisecond {
+		t.Errorf("after reset: waited %v, want 100ms", d)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for range 100 {
+		b := &Backoff{Min: time.Second, Max: 10 * time.Second, Factor: 2, Jitter: 0.2}
+		b.Next()
+		// 第二次为 2s, 抖动后在 1.6s~2.4s 之间
+		d := b.Next()
+		if d < 1600*time.Millisecond || d > 2400*time.Millisecond {
+			t.Fatalf("waited %v, want 2s ± 20%%", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Error("jitter does not vary the wait")
+	}
+
+	// 抖动不会让上限之后的等待超过 Max*(1+Jitter)
+	b := &Backoff{Min: time.Second, Max: 2 * time.Second, Factor: 10, Jitter: 0.5}
+	for range 10 {
+		if d := b.Next(); d > 3*time.Second {
+			t.Fatalf("waited %v beyond the jittered cap", d)
+		}
+	}
+}
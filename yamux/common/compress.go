@@ -0,0 +1,45 @@
+package common
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+)
+
+// compressConn 在协商了 CapCompression 时包装隧道连接,
+// 每次写入后立即 Flush, 保证交互式流量不被缓冲
+type compressConn struct {
+	net.Conn
+	r io.ReadCloser
+	w *flate.Writer
+}
+
+// WrapConn 按协商结果包装隧道连接
+func WrapConn(conn net.Conn, caps Capability) net.Conn {
+	if !caps.Has(CapCompression) {
+		return conn
+	}
+	w, _ := flate.NewWriter(conn, flate.BestSpeed)
+	return &compressConn{
+		Conn: conn,
+		r:    flate.NewReader(conn),
+		w:    w,
+	}
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *compressConn) Close() error {
+	c.r.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,685 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// YamuxConfig yamux 会话参数, 零值表示使用 yamux 默认值
+type YamuxConfig struct {
+	AcceptBacklog          int           `yaml:"accept_backlog"`
+	KeepAliveInterval      time.Duration `yaml:"keepalive_interval"`
+	ConnectionWriteTimeout time.Duration `yaml:"write_timeout"`
+	MaxStreamWindowSize    uint32        `yaml:"max_stream_window"`
+	StreamOpenTimeout      time.Duration `yaml:"stream_open_timeout"`
+}
+
+func (c YamuxConfig) Config() *yamux.Config {
+	conf := yamux.DefaultConfig()
+	if c.AcceptBacklog > 0 {
+		conf.AcceptBacklog = c.AcceptBacklog
+	}
+	if c.KeepAliveInterval > 0 {
+		conf.KeepAliveInterval = c.KeepAliveInterval
+	}
+	if c.ConnectionWriteTimeout > 0 {
+		conf.ConnectionWriteTimeout = c.ConnectionWriteTimeout
+	}
+	if c.MaxStreamWindowSize > 0 {
+		conf.MaxStreamWindowSize = c.MaxStreamWindowSize
+	}
+	if c.StreamOpenTimeout > 0 {
+		conf.StreamOpenTimeout = c.StreamOpenTimeout
+	}
+	return conf
+}
+
+func (c YamuxConfig) validate(v *validator) {
+	if c.AcceptBacklog < 0 {
+		v.errorf("accept_backlog must not be negative")
+	}
+	if c.MaxStreamWindowSize > 0 && c.MaxStreamWindowSize < 256*1024 {
+		v.at("max_stream_window").errorf("must be at least 262144")
+	}
+}
+
+// LogConfig 日志配置
+type LogConfig struct {
+	Level  string `yaml:"level"`  // debug, info, warn, error
+	Format string `yaml:"format"` // text, json
+}
+
+// Apply 应用到 logrus 全局 logger
+func (c LogConfig) Apply() error {
+	if c.Level != "" {
+		level, err := logrus.ParseLevel(c.Level)
+		if err != nil {
+			return err
+		}
+		logrus.SetLevel(level)
+	}
+	switch c.Format {
+	case "", "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", c.Format)
+	}
+	return nil
+}
+
+func (c LogConfig) validate(v *validator) {
+	if c.Level != "" {
+		if _, err := logrus.ParseLevel(c.Level); err != nil {
+			v.at("level").errorf("%v", err)
+		}
+	}
+	if c.Format != "" && c.Format != "text" && c.Format != "json" {
+		v.at("format").errorf("must be text or json")
+	}
+}
+
+// ClientTLS 客户端 TLS 配置段
+type ClientTLS struct {
+	CA         string   `yaml:"ca"`
+	ServerName string   `yaml:"server_name"`
+	Pins       []string `yaml:"pins"`
+	Cert       string   `yaml:"cert"`
+	Key        string   `yaml:"key"`
+	Insecure   bool     `yaml:"insecure"`
+}
+
+func (c ClientTLS) Options() TLSOptions {
+	return TLSOptions{
+		CertFile:   c.Cert,
+		KeyFile:    c.Key,
+		CAFile:     c.CA,
+		ServerName: c.ServerName,
+		Pins:       c.Pins,
+		Insecure:   c.Insecure,
+	}
+}
+
+// ReconnectConfig 断线重连退避参数
+type ReconnectConfig struct {
+	MinDelay time.Duration `yaml:"min_delay"`
+	MaxDelay time.Duration `yaml:"max_delay"`
+}
+
+// UDPConfig UDP 转发参数, 为 0 时使用默认值
+type UDPConfig struct {
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`      // UDP 会话无数据往来时的过期时间
+	MaxDatagramSize int           `yaml:"max_datagram_size"` // 超过该长度的数据报被丢弃
+}
+
+func (c UDPConfig) validate(v *validator) {
+	if c.IdleTimeout < 0 {
+		v.at("idle_timeout").errorf("must not be negative")
+	}
+	if c.MaxDatagramSize < 0 || c.MaxDatagramSize > MaxDatagramSize {
+		v.at("max_datagram_size").errorf("must be between 0 and %d", MaxDatagramSize)
+	}
+}
+
+// ClientConfig yclient 配置文件
+type ClientConfig struct {
+	Server     string          `yaml:"server"`
+	Identity   string          `yaml:"identity"`
+	Secret     string          `yaml:"secret"`
+	SecretFile string          `yaml:"secret_file"`
+	Compress   bool            `yaml:"compress"`
+	TLS        ClientTLS       `yaml:"tls"`
+	Reconnect  ReconnectConfig `yaml:"reconnect"`
+	UDP        UDPConfig       `yaml:"udp"`
+	Yamux      YamuxConfig     `yaml:"yamux"`
+	Log        LogConfig       `yaml:"log"`
+
+	// Forwards 本地端口转发 LISTEN=HOST:PORT, 经由隧道访问服务端网络
+	Forwards []string `yaml:"forwards"`
+
+	// ShutdownTimeout 退出时等待进行中的流结束的最长时间
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+func DefaultClientConfig() *ClientConfig {
+	return &ClientConfig{
+		Server: "192.168.31.142:1080",
+		Reconnect: ReconnectConfig{
+			MinDelay: 500 * time.Millisecond,
+			MaxDelay: 30 * time.Second,
+		},
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+// LoadClientConfig 在默认配置上叠加配置文件
+func LoadClientConfig(path string) (*ClientConfig, error) {
+	cfg := DefaultClientConfig()
+	root, err := loadYAML(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate(path, root)
+}
+
+// Validate 校验配置, 用于命令行参数覆盖之后
+func (c *ClientConfig) Validate() error {
+	return c.validate("", nil)
+}
+
+func (c *ClientConfig) validate(file string, root *yaml.Node) error {
+	v := newValidator(file, root)
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		v.at("server").errorf("%v", err)
+	}
+	if len(c.Identity) > MaxIdentityLen {
+		v.at("identity").errorf("longer than %d bytes", MaxIdentityLen)
+	}
+	if c.Secret != "" && c.SecretFile != "" {
+		v.at("secret_file").errorf("secret and secret_file are mutually exclusive")
+	}
+	if c.Secret == "" && c.SecretFile == "" && c.TLS.Cert == "" {
+		v.errorf("one of secret, secret_file or tls.cert is required")
+	}
+	tls := v.at("tls")
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		tls.at("key").errorf("cert and key must be set together")
+	}
+	if _, err := parsePins(c.TLS.Pins); err != nil {
+		tls.at("pins").errorf("%v", err)
+	}
+	forwards := v.at("forwards")
+	for i, f := range c.Forwards {
+		if _, err := ParseLocalForward(f); err != nil {
+			forwards.index(i).errorf("%v", err)
+		}
+	}
+	if c.Reconnect.MinDelay <= 0 || c.Reconnect.MaxDelay < c.Reconnect.MinDelay {
+		v.at("reconnect").errorf("need 0 < min_delay <= max_delay")
+	}
+	if c.ShutdownTimeout < 0 {
+		v.at("shutdown_timeout").errorf("must not be negative")
+	}
+	c.UDP.validate(v.at("udp"))
+	c.Yamux.validate(v.at("yamux"))
+	c.Log.validate(v.at("log"))
+	return v.err()
+}
+
+// ParsedForwards 返回解析后的本地端口转发, 须在 Validate 之后调用
+func (c *ClientConfig) ParsedForwards() []LocalForward {
+	forwards := make([]LocalForward, 0, len(c.Forwards))
+	for _, s := range c.Forwards {
+		if f, err := ParseLocalForward(s); err == nil {
+			forwards = append(forwards, f)
+		}
+	}
+	return forwards
+}
+
+// LoadSecret 返回配置中的共享密钥
+func (c *ClientConfig) LoadSecret() ([]byte, error) {
+	if c.SecretFile == "" {
+		return []byte(c.Secret), nil
+	}
+	data, err := os.ReadFile(c.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(data), nil
+}
+
+// ServerListen 服务端监听地址
+type ServerListen struct {
+	Entry    string `yaml:"entry"`     // 客户端隧道入口
+	Local    string `yaml:"local"`     // 透明代理本地入口
+	Capture  string `yaml:"capture"`   // 本地入口的捕获方式: redirect (默认) 或 tproxy
+	LocalUDP string `yaml:"local_udp"` // TPROXY 捕获 UDP 的入口, 为空时不启用
+}
+
+// ServerTLS 服务端 TLS 配置段
+type ServerTLS struct {
+	Cert              string `yaml:"cert"`
+	Key               string `yaml:"key"`
+	ClientCA          string `yaml:"client_ca"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+	CertIdentity      bool   `yaml:"cert_identity"`
+}
+
+func (c ServerTLS) Options() TLSOptions {
+	return TLSOptions{
+		CertFile:          c.Cert,
+		KeyFile:           c.Key,
+		CAFile:            c.ClientCA,
+		RequireClientCert: c.RequireClientCert,
+	}
+}
+
+// ServerAuth 客户端密钥, secrets_file 支持热加载, clients 为内联配置
+type ServerAuth struct {
+	SecretsFile string         `yaml:"secrets_file"`
+	Clients     []ClientSecret `yaml:"clients"`
+}
+
+// SecretStore 按配置构造密钥存储
+func (c ServerAuth) SecretStore() (*SecretStore, error) {
+	if c.SecretsFile != "" {
+		return LoadSecretStore(c.SecretsFile)
+	}
+	return NewStaticSecretStore(c.Clients)
+}
+
+// ServerAdmin 管理接口, listen 为空时不启用; 设置 token 后请求须携带
+// "Authorization: Bearer <token>"
+type ServerAdmin struct {
+	Listen string `yaml:"listen"`
+	Token  string `yaml:"token"`
+}
+
+// ServerMetrics Prometheus 指标, listen 为空时不启用, 路径为 /metrics
+type ServerMetrics struct {
+	Listen string `yaml:"listen"`
+}
+
+// ServerAccounting 流量统计, file 为空时只保存在内存中
+type ServerAccounting struct {
+	File          string        `yaml:"file"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// ServerLimits 默认限额与按客户端身份单独配置的限额
+type ServerLimits struct {
+	Default Limits            `yaml:"default"`
+	Clients map[string]Limits `yaml:"clients"`
+}
+
+// Forward 远程端口转发: 服务端监听 listen, 把连接经由身份为 client 的
+// 客户端转发到其网络中的 target; network 为 tcp (默认) 或 udp
+type Forward struct {
+	Listen  string `yaml:"listen" json:"listen"`
+	Client  string `yaml:"client" json:"client"`
+	Target  string `yaml:"target" json:"target"`
+	Network string `yaml:"network,omitempty" json:"network,omitempty"`
+}
+
+// IsUDP 是否为 UDP 转发
+func (f Forward) IsUDP() bool {
+	return f.Network == "udp"
+}
+
+func (f Forward) Validate() error {
+	if f.Network != "" && f.Network != "tcp" && f.Network != "udp" {
+		return fmt.Errorf("network: unsupported %q", f.Network)
+	}
+	if _, _, err := net.SplitHostPort(f.Listen); err != nil {
+		return fmt.Errorf("listen: %v", err)
+	}
+	if f.Client == "" {
+		return errors.New("client is required")
+	}
+	host, port, err := net.SplitHostPort(f.Target)
+	if err != nil {
+		return fmt.Errorf("target: %v", err)
+	}
+	if host == "" {
+		return errors.New("target: missing host")
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("target: invalid port %q", port)
+	}
+	return nil
+}
+
+// ServerAccess 客户端经由隧道可访问的服务端网络目标, 写法见 TargetRule;
+// 没有单独配置的客户端使用 default, 为空时全部拒绝
+type ServerAccess struct {
+	Default []string            `yaml:"default"`
+	Clients map[string][]string `yaml:"clients"`
+}
+
+// ServerConfig yserver 配置文件
+type ServerConfig struct {
+	Listen     ServerListen     `yaml:"listen"`
+	TLS        ServerTLS        `yaml:"tls"`
+	Auth       ServerAuth       `yaml:"auth"`
+	Admin      ServerAdmin      `yaml:"admin"`
+	Metrics    ServerMetrics    `yaml:"metrics"`
+	Accounting ServerAccounting `yaml:"accounting"`
+	Limits     ServerLimits     `yaml:"limits"`
+	Forwards   []Forward        `yaml:"forwards"`
+	Access     ServerAccess     `yaml:"access"`
+	UDP        UDPConfig        `yaml:"udp"`
+	Pool       string           `yaml:"pool"`
+	Pool6      string           `yaml:"pool6"` // 双栈时的 IPv6 地址池, 建议使用 ULA (fd00::/8)
+	LeaseFile  string           `yaml:"lease_file"`
+	Routes     []string         `yaml:"routes"`
+	Yamux      YamuxConfig      `yaml:"yamux"`
+	Log        LogConfig        `yaml:"log"`
+
+	// ShutdownTimeout 退出时等待进行中的转发结束的最长时间
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+func DefaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Listen: ServerListen{
+			Entry: "0.0.0.0:1080",
+			Local: "0.0.0.0:5555",
+		},
+		TLS: ServerTLS{
+			Cert: "../cert/test.crt",
+			Key:  "../cert/test.key",
+		},
+		Auth:      ServerAuth{SecretsFile: "secrets.yaml"},
+		Pool:      "10.0.0.0/24",
+		LeaseFile: "leases.json",
+		Accounting: ServerAccounting{
+			File:          "usage.json",
+			FlushInterval: time.Minute,
+		},
+
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	cfg := DefaultServerConfig()
+	root, err := loadYAML(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	// 只写了内联 clients 时不再使用默认的 secrets_file
+	if len(cfg.Auth.Clients) > 0 && len(root.Content) > 0 &&
+		mappingValue(mappingValue(root.Content[0], "auth"), "secrets_file") == nil {
+		cfg.Auth.SecretsFile = ""
+	}
+	return cfg, cfg.validate(path, root)
+}
+
+func (c *ServerConfig) Validate() error {
+	return c.validate("", nil)
+}
+
+func (c *ServerConfig) validate(file string, root *yaml.Node) error {
+	v := newValidator(file, root)
+	listen := v.at("listen")
+	if _, _, err := net.SplitHostPort(c.Listen.Entry); err != nil {
+		listen.at("entry").errorf("%v", err)
+	}
+	if _, _, err := net.SplitHostPort(c.Listen.Local); err != nil {
+		listen.at("local").errorf("%v", err)
+	}
+	switch c.Listen.Capture {
+	case "", "redirect", "tproxy":
+	default:
+		listen.at("capture").errorf("unknown capture mode %q", c.Listen.Capture)
+	}
+	if c.Listen.LocalUDP != "" {
+		if _, _, err := net.SplitHostPort(c.Listen.LocalUDP); err != nil {
+			listen.at("local_udp").errorf("%v", err)
+		} else if c.Listen.Capture != "tproxy" {
+			listen.at("local_udp").errorf("requires capture: tproxy")
+		}
+	}
+
+	if c.Admin.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			v.at("admin").at("listen").errorf("%v", err)
+		}
+	}
+	if c.Accounting.FlushInterval <= 0 {
+		v.at("accounting").at("flush_interval").errorf("must be positive")
+	}
+	forwards := v.at("forwards")
+	listens := make(map[string]bool, len(c.Forwards))
+	for i, f := range c.Forwards {
+		if err := f.Validate(); err != nil {
+			forwards.index(i).errorf("%v", err)
+		} else if listens[f.Listen] {
+			forwards.index(i).at("listen").errorf("duplicate forward %s", f.Listen)
+		}
+		listens[f.Listen] = true
+	}
+	c.UDP.validate(v.at("udp"))
+
+	access := v.at("access")
+	for i, rule := range c.Access.Default {
+		if _, err := ParseTargetRule(rule); err != nil {
+			access.at("default").index(i).errorf("%v", err)
+		}
+	}
+	for identity, rules := range c.Access.Clients {
+		for i, rule := range rules {
+			if _, err := ParseTargetRule(rule); err != nil {
+				access.at("clients").at(identity).index(i).errorf("%v", err)
+			}
+		}
+	}
+
+	limits := v.at("limits")
+	c.Limits.Default.validate(limits.at("default"))
+	for identity, lim := range c.Limits.Clients {
+		lim.validate(limits.at("clients").at(identity))
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			v.at("metrics").at("listen").errorf("%v", err)
+		}
+	}
+
+	tls := v.at("tls")
+	if c.TLS.Cert == "" || c.TLS.Key == "" {
+		tls.errorf("cert and key are required")
+	}
+	if c.TLS.RequireClientCert && c.TLS.ClientCA == "" {
+		tls.at("require_client_cert").errorf("requires client_ca")
+	}
+	if c.TLS.CertIdentity && c.TLS.ClientCA == "" {
+		tls.at("cert_identity").errorf("requires client_ca")
+	}
+
+	auth := v.at("auth")
+	if c.Auth.SecretsFile != "" && len(c.Auth.Clients) > 0 {
+		auth.errorf("secrets_file and clients are mutually exclusive")
+	}
+	if c.Auth.SecretsFile == "" {
+		if _, err := NewStaticSecretStore(c.Auth.Clients); err != nil {
+			auth.at("clients").errorf("%v", err)
+		}
+	}
+
+	if pool, err := netip.ParsePrefix(c.Pool); err != nil {
+		v.at("pool").errorf("%v", err)
+	} else if pool.Bits() >= pool.Addr().BitLen()-1 {
+		v.at("pool").errorf("pool %s is too small", pool)
+	} else if c.Pool6 != "" && !pool.Addr().Is4() {
+		v.at("pool").errorf("must be IPv4 when pool6 is set")
+	}
+	if c.Pool6 != "" {
+		if pool6, err := netip.ParsePrefix(c.Pool6); err != nil {
+			v.at("pool6").errorf("%v", err)
+		} else if !pool6.Addr().Is6() || pool6.Addr().Is4In6() {
+			v.at("pool6").errorf("must be an IPv6 prefix")
+		} else if pool6.Bits() >= 127 {
+			v.at("pool6").errorf("pool %s is too small", pool6)
+		}
+	}
+	routes := v.at("routes")
+	for i, s := range c.Routes {
+		if _, err := ParseRoute(s); err != nil {
+			routes.index(i).errorf("%v", err)
+		}
+	}
+	if c.ShutdownTimeout < 0 {
+		v.at("shutdown_timeout").errorf("must not be negative")
+	}
+	c.Yamux.validate(v.at("yamux"))
+	c.Log.validate(v.at("log"))
+	return v.err()
+}
+
+// Pools 返回主地址池与可选的 IPv6 地址池, 须在 Validate 之后调用
+func (c *ServerConfig) Pools() []netip.Prefix {
+	pools := []netip.Prefix{netip.MustParsePrefix(c.Pool)}
+	if c.Pool6 != "" {
+		pools = append(pools, netip.MustParsePrefix(c.Pool6))
+	}
+	return pools
+}
+
+// ParsedRoutes 返回解析后的静态路由, 须在 Validate 之后调用
+func (c *ServerConfig) ParsedRoutes() []Route {
+	routes := make([]Route, 0, len(c.Routes))
+	for _, s := range c.Routes {
+		if r, err := ParseRoute(s); err == nil {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// loadYAML 严格解码配置文件, 未知字段视为错误, 同时返回语法树用于定位行号
+func loadYAML(path string, out any) (*yaml.Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &root, nil
+}
+
+// ConfigError 带位置信息的配置错误
+type ConfigError struct {
+	File string
+	Line int
+	Path string
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		b.WriteString(":")
+		if e.Line > 0 {
+			fmt.Fprintf(&b, "%d:", e.Line)
+		}
+		b.WriteString(" ")
+	}
+	if e.Path != "" {
+		b.WriteString(e.Path)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// ConfigErrors 校验发现的全部错误
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// validator 记录当前校验的字段路径及其在 YAML 中的节点
+type validator struct {
+	file   string
+	root   *yaml.Node
+	path   string
+	node   *yaml.Node
+	errors *ConfigErrors
+}
+
+func newValidator(file string, root *yaml.Node) *validator {
+	return &validator{file: file, root: root, errors: &ConfigErrors{}}
+}
+
+func (v *validator) at(key string) *validator {
+	path := key
+	if v.path != "" {
+		path = v.path + "." + key
+	}
+	return v.child(path, mappingValue(v.current(), key))
+}
+
+func (v *validator) index(i int) *validator {
+	var node *yaml.Node
+	if cur := v.current(); cur != nil && cur.Kind == yaml.SequenceNode && i < len(cur.Content) {
+		node = cur.Content[i]
+	}
+	return v.child(fmt.Sprintf("%s[%d]", v.path, i), node)
+}
+
+func (v *validator) child(path string, node *yaml.Node) *validator {
+	if node == nil {
+		node = v.node
+	}
+	return &validator{file: v.file, root: v.root, path: path, node: node, errors: v.errors}
+}
+
+func (v *validator) current() *yaml.Node {
+	if v.node != nil {
+		return v.node
+	}
+	if v.root == nil || len(v.root.Content) == 0 {
+		return nil
+	}
+	if v.path == "" {
+		return v.root.Content[0]
+	}
+	return nil
+}
+
+func (v *validator) errorf(format string, args ...any) {
+	e := ConfigError{File: v.file, Path: v.path, Msg: fmt.Sprintf(format, args...)}
+	if node := v.current(); node != nil {
+		e.Line = node.Line
+	}
+	*v.errors = append(*v.errors, e)
+}
+
+func (v *validator) err() error {
+	if len(*v.errors) == 0 {
+		return nil
+	}
+	return *v.errors
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
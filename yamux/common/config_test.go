@@ -0,0 +1,50 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadServerConfigReportsLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "yserver.yaml")
+	data := `listen:
+  entry: "0.0.0.0:1080"
+  local: "no-port"
+auth:
+  clients:
+    - identity: alice
+      secret: s3cret
+routes:
+  - 10.0.2.0/24=10.0.0.2
+  - bogus
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadServerConfig(path)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("err = %v, want ConfigErrors", err)
+	}
+	want := map[string]int{"listen.local": 3, "routes[1]": 10}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d: %v", len(errs), len(want), err)
+	}
+	for _, e := range errs {
+		if line, ok := want[e.Path]; !ok || e.Line != line {
+			t.Errorf("unexpected error %q (line %d)", e.Error(), e.Line)
+		}
+	}
+}
+
+func TestLoadConfigExamples(t *testing.T) {
+	if _, err := LoadServerConfig("../config/yserver.example.yaml"); err != nil {
+		t.Errorf("yserver example: %v", err)
+	}
+	if _, err := LoadClientConfig("../config/yclient.example.yaml"); err != nil {
+		t.Errorf("yclient example: %v", err)
+	}
+}
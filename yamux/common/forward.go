@@ -0,0 +1,39 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// LocalForward 本地端口转发: 客户端监听 Listen, 经由隧道连接服务端网络中的 Host:Port
+type LocalForward struct {
+	Listen string
+	Host   string
+	Port   uint16
+}
+
+// ParseLocalForward 解析 "LISTEN=HOST:PORT", 如 "127.0.0.1:15432=db.internal:5432"
+func ParseLocalForward(s string) (LocalForward, error) {
+	listen, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return LocalForward{}, fmt.Errorf("invalid forward %q, want LISTEN=HOST:PORT", s)
+	}
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return LocalForward{}, fmt.Errorf("invalid forward %q: %v", s, err)
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return LocalForward{}, fmt.Errorf("invalid forward %q: %v", s, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 || host == "" {
+		return LocalForward{}, fmt.Errorf("invalid forward %q: bad target %s", s, target)
+	}
+	return LocalForward{Listen: listen, Host: host, Port: uint16(port)}, nil
+}
+
+func (f LocalForward) String() string {
+	return f.Listen + "=" + net.JoinHostPort(f.Host, strconv.Itoa(int(f.Port)))
+}
@@ -0,0 +1,248 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// 隧道握手流程:
+//
+//	client -> server: | MAGIC "TS" | VER (1) | CAPS (4) |
+//	server -> client: | VER (1) | CAPS (4) |               双方都支持的版本与能力
+//	                  ... 认证, 见 auth.go ...
+//	server -> client: | CODE (1) | MSG_LEN (2) | MSG |     CODE 为 0 表示握手成功
+//
+// 版本不兼容时服务端回复 VER 0 后直接发送结果.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+var helloMagic = []byte("TS")
+
+// Capability 握手时协商的能力位
+type Capability uint32
+
+const (
+	CapCompression Capability = 1 << iota // 隧道数据压缩
+	CapUDP                                // UDP 转发
+	CapControl                            // 控制通道, 保留, 尚未实现
+	CapForward                            // 客户端向服务端打开流, 访问服务端网络
+)
+
+// SupportedCaps 本端实现的全部能力; CapControl 尚未实现, 不参与协商
+const SupportedCaps = CapCompression | CapUDP | CapForward
+
+func (c Capability) Has(cap Capability) bool {
+	return c&cap == cap
+}
+
+func (c Capability) String() string {
+	var names []string
+	for _, v := range []struct {
+		cap  Capability
+		name string
+	}{
+		{CapCompression, "compression"},
+		{CapUDP, "udp"},
+		{CapControl, "control"},
+		{CapForward, "forward"},
+	} {
+		if c.Has(v.cap) {
+			names = append(names, v.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// RejectCode 握手失败原因
+type RejectCode uint8
+
+const (
+	RejectNone RejectCode = iota
+	RejectVersion
+	RejectAuth
+	RejectRevoked
+	RejectPoolExhausted
+	RejectInternal
+)
+
+func (c RejectCode) String() string {
+	switch c {
+	case RejectNone:
+		return "ok"
+	case RejectVersion:
+		return "unsupported version"
+	case RejectAuth:
+		return "authentication failed"
+	case RejectRevoked:
+		return "identity revoked"
+	case RejectPoolExhausted:
+		return "address pool exhausted"
+	case RejectInternal:
+		return "internal error"
+	default:
+		return fmt.Sprintf("reject code %d", uint8(c))
+	}
+}
+
+// RejectError 服务端拒绝握手
+type RejectError struct {
+	Code    RejectCode
+	Message string
+}
+
+func (e *RejectError) Error() string {
+	if e.Message == "" {
+		return "handshake rejected: " + e.Code.String()
+	}
+	return fmt.Sprintf("handshake rejected: %s: %s", e.Code, e.Message)
+}
+
+func (e *RejectError) Is(target error) bool {
+	switch target {
+	case ErrAuthFailed:
+		return e.Code == RejectAuth || e.Code == RejectRevoked
+	case ErrRevoked:
+		return e.Code == RejectRevoked
+	case ErrPoolExhausted:
+		return e.Code == RejectPoolExhausted
+	}
+	return false
+}
+
+// Handshake 握手协商结果
+type Handshake struct {
+	Version  uint8
+	Caps     Capability
+	Identity string
+}
+
+// ClientHandshake 客户端发起版本协商并认证
+func ClientHandshake(conn net.Conn, identity string, secret []byte, caps Capability) (*Handshake, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, 0, 7)
+	hello = append(hello, helloMagic...)
+	hello = append(hello, ProtocolVersion)
+	hello = binary.BigEndian.AppendUint32(hello, uint32(caps))
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	hs := &Handshake{
+		Version:  reply[0],
+		Caps:     Capability(binary.BigEndian.Uint32(reply[1:])),
+		Identity: identity,
+	}
+
+	if hs.Version != 0 {
+		if err := PipeAuth(conn, identity, secret); err != nil {
+			return nil, err
+		}
+	}
+	if err := readResult(conn); err != nil {
+		return nil, err
+	}
+	return hs, nil
+}
+
+// ServerHandshake 服务端完成版本协商与认证; admit 在认证通过后调用,
+// 如分配虚拟地址, 其返回的错误作为拒绝原因发给客户端
+func ServerHandshake(conn net.Conn, secrets SecretLookup, caps Capability, admit func(identity string) error) (*Handshake, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, 7)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, err
+	}
+	if string(hello[:2]) != string(helloMagic) {
+		return nil, errors.New("bad hello magic")
+	}
+
+	version := hello[2]
+	if version < MinProtocolVersion {
+		conn.Write([]byte{0, 0, 0, 0, 0})
+		err := &RejectError{Code: RejectVersion, Message: fmt.Sprintf("server supports %d-%d", MinProtocolVersion, ProtocolVersion)}
+		return nil, writeResult(conn, err)
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	hs := &Handshake{
+		Version: version,
+		Caps:    Capability(binary.BigEndian.Uint32(hello[3:])) & caps,
+	}
+
+	reply := make([]byte, 0, 5)
+	reply = append(reply, hs.Version)
+	reply = binary.BigEndian.AppendUint32(reply, uint32(hs.Caps))
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+
+	identity, err := PipeCheck(conn, secrets)
+	if err == nil && admit != nil {
+		err = admit(identity)
+	}
+	if err != nil {
+		var reject *RejectError
+		if !errors.As(err, &reject) {
+			reject = &RejectError{Code: RejectInternal}
+			if errors.Is(err, ErrPoolExhausted) {
+				reject.Code = RejectPoolExhausted
+			}
+		}
+		writeResult(conn, reject)
+		return nil, err
+	}
+	hs.Identity = identity
+	return hs, writeResult(conn, nil)
+}
+
+// writeResult 发送握手结果, 拒绝时同时返回该错误
+func writeResult(conn net.Conn, reject *RejectError) error {
+	code, msg := RejectNone, ""
+	if reject != nil {
+		code, msg = reject.Code, reject.Message
+	}
+	buf := []byte{byte(code)}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg)))
+	buf = append(buf, msg...)
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	if reject != nil {
+		return reject
+	}
+	return nil
+}
+
+func readResult(conn net.Conn) error {
+	code := make([]byte, 1)
+	if _, err := io.ReadFull(conn, code); err != nil {
+		return err
+	}
+	msg, err := readFrame(conn, 1<<16-1)
+	if err != nil {
+		return err
+	}
+	if RejectCode(code[0]) != RejectNone {
+		return &RejectError{Code: RejectCode(code[0]), Message: string(msg)}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+type handshakeResult struct {
+	server    *Handshake
+	serverErr error
+	client    *Handshake
+	clientErr error
+}
+
+func runHandshake(t *testing.T, secrets SecretLookup, identity, secret string, clientCaps, serverCaps Capability, admit func(string) error) handshakeResult {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	var res handshakeResult
+	done := make(chan struct{})
+	go func() {
+		res.client, res.clientErr = ClientHandshake(c1, identity, []byte(secret), clientCaps)
+		close(done)
+	}()
+	res.server, res.serverErr = ServerHandshake(c2, secrets, serverCaps, admit)
+	<-done
+	return res
+}
+
+func TestHandshake(t *testing.T) {
+	longID := strings.Repeat("x", 300)
+	secrets, err := NewStaticSecretStore([]ClientSecret{
+		{Identity: "alice", Secret: "s3cret"},
+		{Identity: longID, Secret: strings.Repeat("k", 512)},
+		{Identity: "mallory", Secret: "old", Revoked: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := runHandshake(t, secrets, "alice", "s3cret", CapUDP|CapCompression, CapUDP|CapControl, nil)
+	if res.serverErr != nil || res.clientErr != nil {
+		t.Fatalf("valid handshake: server=%v client=%v", res.serverErr, res.clientErr)
+	}
+	if res.server.Identity != "alice" || res.server.Caps != CapUDP || res.client.Caps != CapUDP {
+		t.Fatalf("negotiated %q %s/%s, want alice udp", res.server.Identity, res.server.Caps, res.client.Caps)
+	}
+
+	res = runHandshake(t, secrets, longID, strings.Repeat("k", 512), 0, SupportedCaps, nil)
+	if res.serverErr != nil || res.clientErr != nil || res.server.Identity != longID {
+		t.Fatalf("long identity: server=%v client=%v", res.serverErr, res.clientErr)
+	}
+
+	for _, tc := range []struct {
+		identity, secret string
+		code             RejectCode
+	}{
+		{"alice", "wrong", RejectAuth},
+		{"nobody", "s3cret", RejectAuth},
+		// 吊销与认证失败对客户端不做区分
+		{"mallory", "old", RejectAuth},
+	} {
+		res = runHandshake(t, secrets, tc.identity, tc.secret, 0, SupportedCaps, nil)
+		var reject *RejectError
+		if !errors.As(res.clientErr, &reject) || reject.Code != tc.code {
+			t.Errorf("%s/%s: client err = %v, want %s", tc.identity, tc.secret, res.clientErr, tc.code)
+		}
+		if !errors.Is(res.serverErr, ErrAuthFailed) {
+			t.Errorf("%s/%s: server err = %v, want ErrAuthFailed", tc.identity, tc.secret, res.serverErr)
+		}
+		if revoked := errors.Is(res.serverErr, ErrRevoked); revoked != (tc.identity == "mallory") {
+			t.Errorf("%s/%s: server err = %v, revoked %v", tc.identity, tc.secret, res.serverErr, revoked)
+		}
+	}
+
+	res = runHandshake(t, secrets, "alice", "s3cret", 0, SupportedCaps, func(string) error { return ErrPoolExhausted })
+	if !errors.Is(res.clientErr, ErrPoolExhausted) {
+		t.Errorf("admit failure: client err = %v, want pool exhausted", res.clientErr)
+	}
+}
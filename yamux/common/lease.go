@@ -0,0 +1,210 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrPoolExhausted = errors.New("virtual address pool exhausted")
+
+// Lease 客户端身份与虚拟地址的绑定关系
+type Lease struct {
+	Identity string    `json:"identity"`
+	Addr     string    `json:"addr"`            // 主地址, 会话以其标识
+	Addr6    string    `json:"addr6,omitempty"` // 双栈时从 IPv6 地址池分配的地址
+	Updated  time.Time `json:"updated"`
+}
+
+// LeaseStore 为客户端分配虚拟地址, 并持久化到本地文件,
+// 保证同一身份在重连和服务端重启后拿到相同的地址
+type LeaseStore struct {
+	sync.Mutex
+	path   string
+	pool   netip.Prefix      // 主地址池, IPv4 或 IPv6
+	pool6  netip.Prefix      // 双栈时的 IPv6 地址池, 可为空
+	leases map[string]*Lease // identity -> lease
+}
+
+// LoadLeaseStore 从 path 加载租约, path 为空时只保存在内存中.
+// pools 依次为主地址池与可选的 IPv6 地址池, 后者要求主地址池为 IPv4,
+// 此时每个身份各分配一个 IPv4 与 IPv6 地址
+func LoadLeaseStore(path string, pools ...netip.Prefix) (*LeaseStore, error) {
+	if len(pools) == 0 || len(pools) > 2 {
+		return nil, errors.New("need a primary pool and at most one IPv6 pool")
+	}
+	s := &LeaseStore{
+		path:   path,
+		pool:   pools[0].Masked(),
+		leases: make(map[string]*Lease),
+	}
+	if len(pools) == 2 {
+		if !s.pool.Addr().Is4() || !pools[1].Addr().Is6() {
+			return nil, fmt.Errorf("dual-stack pools must be IPv4 and IPv6, got %s and %s", pools[0], pools[1])
+		}
+		s.pool6 = pools[1].Masked()
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []*Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, err
+	}
+	for _, l := range leases {
+		s.leases[l.Identity] = l
+	}
+	return s, nil
+}
+
+// Acquire 返回 identity 的主地址, 没有租约时从地址池中分配新地址;
+// 配置了 IPv6 地址池而旧租约没有 IPv6 地址时补充分配
+func (s *LeaseStore) Acquire(identity string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	l, ok := s.leases[identity]
+	if !ok {
+		addr, err := s.allocLocked(s.pool)
+		if err != nil {
+			return "", err
+		}
+		l = &Lease{Identity: identity, Addr: addr}
+	}
+	if s.pool6.IsValid() && l.Addr6 == "" {
+		addr6, err := s.allocLocked(s.pool6)
+		if err != nil {
+			return "", err
+		}
+		l.Addr6 = addr6
+	}
+	l.Updated = time.Now()
+	s.leases[identity] = l
+	return l.Addr, s.save()
+}
+
+// allocLocked 返回 pool 中第一个未被占用的地址
+func (s *LeaseStore) allocLocked(pool netip.Prefix) (string, error) {
+	leased := make(map[string]bool, len(s.leases))
+	for _, l := range s.leases {
+		leased[l.Addr] = true
+		if l.Addr6 != "" {
+			leased[l.Addr6] = true
+		}
+	}
+	for addr := pool.Addr().Next(); usable(pool, addr); addr = addr.Next() {
+		if !leased[addr.String()] {
+			return addr.String(), nil
+		}
+	}
+	return "", ErrPoolExhausted
+}
+
+// usable 地址池中可分配的地址: 不含网络地址, IPv4 也不含末尾的广播地址
+func usable(pool netip.Prefix, addr netip.Addr) bool {
+	if !pool.Contains(addr) || addr == pool.Addr() {
+		return false
+	}
+	return !addr.Is4() || pool.Contains(addr.Next())
+}
+
+// Lookup 返回 identity 的租约
+func (s *LeaseStore) Lookup(identity string) (Lease, bool) {
+	s.Lock()
+	defer s.Unlock()
+	l, ok := s.leases[identity]
+	if !ok {
+		return Lease{}, false
+	}
+	return *l, true
+}
+
+// Reassign 把 identity 在 addr 所属地址池中的地址改为 addr,
+// addr 必须未被其他身份占用
+func (s *LeaseStore) Reassign(identity, addr string) error {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return err
+	}
+	primary := usable(s.pool, ip)
+	if !primary && !usable(s.pool6, ip) {
+		return fmt.Errorf("%s is not a usable address of pool %s", addr, s.pools())
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, l := range s.leases {
+		if (l.Addr == ip.String() || l.Addr6 == ip.String()) && l.Identity != identity {
+			return fmt.Errorf("%s is leased to %s", addr, l.Identity)
+		}
+	}
+	l, ok := s.leases[identity]
+	if !ok {
+		if !primary {
+			return fmt.Errorf("%s has no lease", identity)
+		}
+		l = &Lease{Identity: identity}
+		s.leases[identity] = l
+	}
+	if primary {
+		l.Addr = ip.String()
+	} else {
+		l.Addr6 = ip.String()
+	}
+	l.Updated = time.Now()
+	return s.save()
+}
+
+func (s *LeaseStore) pools() string {
+	if s.pool6.IsValid() {
+		return s.pool.String() + ", " + s.pool6.String()
+	}
+	return s.pool.String()
+}
+
+// Release 删除 identity 的租约, 地址回到地址池
+func (s *LeaseStore) Release(identity string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.leases, identity)
+	return s.save()
+}
+
+func (s *LeaseStore) Leases() []Lease {
+	s.Lock()
+	defer s.Unlock()
+	leases := make([]Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		leases = append(leases, *l)
+	}
+	return leases
+}
+
+// save 把租约写回文件
+func (s *LeaseStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	leases := make([]*Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		leases = append(leases, l)
+	}
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
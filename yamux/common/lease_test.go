@@ -0,0 +1,96 @@
+package common
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+)
+
+func TestLeaseStorePersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	pool := netip.MustParsePrefix("10.0.0.0/30")
+
+	store, err := LoadLeaseStore(path, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := store.Acquire("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := store.Acquire("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != "10.0.0.1" || b != "10.0.0.2" {
+		t.Fatalf("got %s, %s, want 10.0.0.1, 10.0.0.2", a, b)
+	}
+	if _, err := store.Acquire("carol"); err != ErrPoolExhausted {
+		t.Fatalf("Acquire on full pool: err = %v, want ErrPoolExhausted", err)
+	}
+
+	// 重新加载后身份保持原地址
+	store, err = LoadLeaseStore(path, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Acquire("bob"); got != b {
+		t.Errorf("bob after reload = %s, want %s", got, b)
+	}
+
+	if err := store.Release("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Acquire("carol"); got != a {
+		t.Errorf("carol = %s, want released %s", got, a)
+	}
+}
+
+func TestLeaseStoreDualStack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	pool := netip.MustParsePrefix("10.0.0.0/24")
+	pool6 := netip.MustParsePrefix("fd00:7473::/64")
+
+	if _, err := LoadLeaseStore(path, pool6, pool); err == nil {
+		t.Error("IPv6 primary with a second pool accepted")
+	}
+
+	// 原有的 IPv4 租约在启用 IPv6 地址池后补充分配 IPv6 地址
+	v4only, err := LoadLeaseStore(path, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v4only.Acquire("alice"); err != nil {
+		t.Fatal(err)
+	}
+	store, err := LoadLeaseStore(path, pool, pool6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, identity := range []string{"alice", "bob"} {
+		if _, err := store.Acquire(identity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, _ := store.Lookup("alice")
+	bob, _ := store.Lookup("bob")
+	if alice.Addr != "10.0.0.1" || alice.Addr6 != "fd00:7473::1" {
+		t.Errorf("alice = %s, %s", alice.Addr, alice.Addr6)
+	}
+	if bob.Addr != "10.0.0.2" || bob.Addr6 != "fd00:7473::2" {
+		t.Errorf("bob = %s, %s", bob.Addr, bob.Addr6)
+	}
+
+	if err := store.Reassign("bob", "fd00:7473::1"); err == nil {
+		t.Error("reassigned an address leased to alice")
+	}
+	if err := store.Reassign("bob", "fd00:7473::ffff:1"); err != nil {
+		t.Fatal(err)
+	}
+	if bob, _ = store.Lookup("bob"); bob.Addr != "10.0.0.2" || bob.Addr6 != "fd00:7473::ffff:1" {
+		t.Errorf("bob after reassign = %s, %s", bob.Addr, bob.Addr6)
+	}
+	if err := store.Reassign("bob", "fd00:1::1"); err == nil {
+		t.Error("reassigned an address outside the pools")
+	}
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Serve 循环接受连接并交给 handle 处理; 出错时退避重试,
+// 避免 fd 耗尽等情况下空转, 监听器被关闭后返回 nil
+func Serve(ln net.Listener, handle func(net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if !isTemporary(err) {
+				return err
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			logrus.Errorf("接受连接失败: %v, retry in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go handle(conn)
+	}
+}
+
+// isTemporary 判断 Accept 错误是否可重试, 如 EMFILE/ECONNABORTED
+func isTemporary(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
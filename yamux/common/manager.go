@@ -1,56 +1,442 @@
 package common
 
 import (
+	"fmt"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/yamux"
 	"github.com/sirupsen/logrus"
 )
 
+// PingInterval 会话 RTT 采样间隔
+var PingInterval = 30 * time.Second
+
+type EventType int
+
+const (
+	EventConnect EventType = iota
+	EventDisconnect
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnect:
+		return "connect"
+	case EventDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// Event 会话上下线事件
+type Event struct {
+	Type EventType
+	Info SessionInfo
+}
+
+// SessionInfo 会话的状态快照
+type SessionInfo struct {
+	Addr        string
+	Aliases     []string // 双栈时另一协议族的虚拟地址, 同样指向该会话
+	Identity    string
+	Caps        Capability
+	CertAuth    bool // 以客户端证书认证, 身份可以不在密钥文件中
+	RemoteAddr  string
+	ConnectedAt time.Time
+	RTT         time.Duration
+	NumStreams  int
+	Draining    bool
+	Session     *yamux.Session `json:"-"`
+}
+
+// StreamInfo 经由会话转发的流
+type StreamInfo struct {
+	ID       uint32
+	Kind     string // 如 "tcp", "udp", "forward"
+	Source   string
+	Dest     string
+	OpenedAt time.Time
+}
+
+type sessionEntry struct {
+	addr        string
+	aliases     []string
+	identity    string
+	caps        Capability
+	certAuth    bool
+	session     *yamux.Session
+	connectedAt time.Time
+	rtt         time.Duration
+	draining    bool
+	streams     map[*StreamInfo]struct{}
+}
+
+func (e *sessionEntry) info() SessionInfo {
+	return SessionInfo{
+		Addr:        e.addr,
+		Aliases:     append([]string(nil), e.aliases...),
+		Identity:    e.identity,
+		Caps:        e.caps,
+		CertAuth:    e.certAuth,
+		RemoteAddr:  e.session.RemoteAddr().String(),
+		ConnectedAt: e.connectedAt,
+		RTT:         e.rtt,
+		NumStreams:  e.session.NumStreams(),
+		Draining:    e.draining,
+		Session:     e.session,
+	}
+}
+
 type Manager struct {
 	sync.Mutex
-	addr2session map[string]*yamux.Session
+	addr2session map[string]*sessionEntry
+	aliases      map[string]string // 别名 -> 主地址
+
+	// eventMu 从修改会话表到发布事件全程持有, 保证订阅者收到的事件顺序与会话表的变化一致
+	eventMu sync.Mutex
+
+	subMu       sync.Mutex
+	subscribers map[int]func(Event)
+	nextSub     int
 }
 
 func NewManager() *Manager {
 	return &Manager{
-		addr2session: make(map[string]*yamux.Session),
+		addr2session: make(map[string]*sessionEntry),
+		aliases:      make(map[string]string),
+		subscribers:  make(map[int]func(Event)),
 	}
 }
 
-func (m *Manager) Add(addr string, session *yamux.Session) {
+// Add 登记会话, 同一地址上的旧会话被关闭; 会话关闭后自动移除.
+// aliases 为会话的其他虚拟地址, 查询时与主地址等价
+func (m *Manager) Add(addr, identity string, caps Capability, certAuth bool, session *yamux.Session, aliases ...string) {
+	entry := &sessionEntry{
+		addr:        addr,
+		aliases:     aliases,
+		identity:    identity,
+		caps:        caps,
+		certAuth:    certAuth,
+		session:     session,
+		connectedAt: time.Now(),
+		streams:     make(map[*StreamInfo]struct{}),
+	}
+
+	m.eventMu.Lock()
+	defer m.eventMu.Unlock()
 	m.Lock()
-	defer m.Unlock()
-	m.addr2session[addr] = session
+	old := m.addr2session[addr]
+	if old != nil {
+		m.unaliasLocked(old)
+	}
+	m.addr2session[addr] = entry
+	for _, alias := range aliases {
+		m.aliases[alias] = addr
+	}
+	info := entry.info()
+	var oldInfo SessionInfo
+	if old != nil {
+		oldInfo = old.info()
+	}
+	m.Unlock()
+
+	if old != nil {
+		logrus.Warnf("Replace stale session of %s (%s)", old.identity, addr)
+		old.session.Close()
+		m.publish(Event{Type: EventDisconnect, Info: oldInfo})
+	}
+	m.publish(Event{Type: EventConnect, Info: info})
+
+	go m.watch(entry)
+}
+
+// watch 定期采样 RTT, 会话关闭时将其移除
+func (m *Manager) watch(entry *sessionEntry) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+
+	m.ping(entry)
+	for {
+		select {
+		case <-entry.session.CloseChan():
+			m.remove(entry)
+			return
+		case <-ticker.C:
+			m.ping(entry)
+		}
+	}
+}
+
+func (m *Manager) ping(entry *sessionEntry) {
+	rtt, err := entry.session.Ping()
+	if err != nil {
+		logrus.Warnf("Ping session %s failed: %v", entry.identity, err)
+		entry.session.Close()
+		return
+	}
+	m.Lock()
+	entry.rtt = rtt
+	m.Unlock()
+}
+
+// remove 仅当地址仍指向该会话时移除, 避免误删重连后的新会话
+func (m *Manager) remove(entry *sessionEntry) {
+	m.eventMu.Lock()
+	defer m.eventMu.Unlock()
+	m.Lock()
+	cur, ok := m.addr2session[entry.addr]
+	if !ok || cur != entry {
+		m.Unlock()
+		return
+	}
+	delete(m.addr2session, entry.addr)
+	m.unaliasLocked(entry)
+	info := entry.info()
+	m.Unlock()
+
+	logrus.Infof("Session %s (%s) closed", info.Addr, entry.identity)
+	m.publish(Event{Type: EventDisconnect, Info: info})
 }
 
+func (m *Manager) unaliasLocked(entry *sessionEntry) {
+	for _, alias := range entry.aliases {
+		if m.aliases[alias] == entry.addr {
+			delete(m.aliases, alias)
+		}
+	}
+}
+
+// entryLocked 按主地址或别名查找会话
+func (m *Manager) entryLocked(addr string) (*sessionEntry, bool) {
+	if primary, ok := m.aliases[addr]; ok {
+		addr = primary
+	}
+	entry, ok := m.addr2session[addr]
+	return entry, ok
+}
+
+// Get 返回可用于新建流的会话, 排空中的会话不再返回
 func (m *Manager) Get(addr string) *yamux.Session {
 	m.Lock()
 	defer m.Unlock()
-	session, ok := m.addr2session[addr]
-	if !ok {
+	entry, ok := m.entryLocked(addr)
+	if !ok || entry.draining {
 		return nil
 	}
-	return session
+	return entry.session
+}
+
+// Lookup 按客户端身份查找可用于新建流的会话
+func (m *Manager) Lookup(identity string) (SessionInfo, bool) {
+	m.Lock()
+	defer m.Unlock()
+	for _, entry := range m.addr2session {
+		if entry.identity == identity && !entry.draining {
+			return entry.info(), true
+		}
+	}
+	return SessionInfo{}, false
+}
+
+// Info 返回会话快照
+func (m *Manager) Info(addr string) (SessionInfo, bool) {
+	m.Lock()
+	defer m.Unlock()
+	entry, ok := m.entryLocked(addr)
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return entry.info(), true
 }
 
+// Sessions 返回全部会话快照, 按地址排序
+func (m *Manager) Sessions() []SessionInfo {
+	m.Lock()
+	defer m.Unlock()
+	sessions := make([]SessionInfo, 0, len(m.addr2session))
+	for _, entry := range m.addr2session {
+		sessions = append(sessions, entry.info())
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Addr < sessions[j].Addr })
+	return sessions
+}
+
+// Remove 移除并关闭会话
 func (m *Manager) Remove(addr string) {
+	m.Lock()
+	entry, ok := m.entryLocked(addr)
+	m.Unlock()
+	if ok {
+		m.remove(entry)
+		entry.session.Close()
+	}
+}
+
+// Drain 不再向会话分配新的流, 并通知对端不要再打开新流,
+// 现有流全部结束后关闭会话
+func (m *Manager) Drain(addr string) error {
+	m.Lock()
+	entry, ok := m.entryLocked(addr)
+	if ok {
+		entry.draining = true
+	}
+	m.Unlock()
+	if !ok {
+		return fmt.Errorf("no session for %s", addr)
+	}
+
+	entry.session.GoAway()
+	go func() {
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-entry.session.CloseChan():
+				return
+			case <-ticker.C:
+				if entry.session.NumStreams() == 0 {
+					logrus.Infof("Session %s drained", addr)
+					entry.session.Close()
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Rename 把会话的主地址或别名 oldAddr 改为 newAddr, 订阅者依次收到旧地址下线与新地址上线事件
+func (m *Manager) Rename(oldAddr, newAddr string) error {
+	m.eventMu.Lock()
+	defer m.eventMu.Unlock()
+	m.Lock()
+	entry, ok := m.entryLocked(oldAddr)
+	if !ok {
+		m.Unlock()
+		return fmt.Errorf("no session for %s", oldAddr)
+	}
+	if _, busy := m.entryLocked(newAddr); busy {
+		m.Unlock()
+		return fmt.Errorf("address %s is in use", newAddr)
+	}
+	oldInfo := entry.info()
+	if entry.addr == oldAddr {
+		delete(m.addr2session, oldAddr)
+		entry.addr = newAddr
+		m.addr2session[newAddr] = entry
+		for _, alias := range entry.aliases {
+			m.aliases[alias] = newAddr
+		}
+	} else {
+		delete(m.aliases, oldAddr)
+		entry.aliases = slices.Clone(entry.aliases)
+		entry.aliases[slices.Index(entry.aliases, oldAddr)] = newAddr
+		m.aliases[newAddr] = entry.addr
+	}
+	newInfo := entry.info()
+	m.Unlock()
+
+	m.publish(Event{Type: EventDisconnect, Info: oldInfo})
+	m.publish(Event{Type: EventConnect, Info: newInfo})
+	return nil
+}
+
+// TrackStream 登记一条经由 session 转发的流, 返回的函数在流结束时调用
+func (m *Manager) TrackStream(session *yamux.Session, stream *yamux.Stream, kind, src, dst string) func() {
+	info := &StreamInfo{
+		ID:       stream.StreamID(),
+		Kind:     kind,
+		Source:   src,
+		Dest:     dst,
+		OpenedAt: time.Now(),
+	}
+
+	m.Lock()
+	entry := m.entryOf(session)
+	if entry != nil {
+		entry.streams[info] = struct{}{}
+	}
+	m.Unlock()
+
+	return func() {
+		if entry == nil {
+			return
+		}
+		m.Lock()
+		delete(entry.streams, info)
+		m.Unlock()
+	}
+}
+
+// Streams 返回会话上登记的流
+func (m *Manager) Streams(addr string) ([]StreamInfo, bool) {
 	m.Lock()
 	defer m.Unlock()
-	delete(m.addr2session, addr)
+	entry, ok := m.entryLocked(addr)
+	if !ok {
+		return nil, false
+	}
+	streams := make([]StreamInfo, 0, len(entry.streams))
+	for info := range entry.streams {
+		streams = append(streams, *info)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].ID < streams[j].ID })
+	return streams, true
+}
+
+func (m *Manager) entryOf(session *yamux.Session) *sessionEntry {
+	for _, entry := range m.addr2session {
+		if entry.session == session {
+			return entry
+		}
+	}
+	return nil
 }
 
 func (m *Manager) IsExist(addr string) bool {
 	m.Lock()
 	defer m.Unlock()
-	_, ok := m.addr2session[addr]
+	_, ok := m.entryLocked(addr)
 	return ok
 }
 
+// Subscribe 订阅会话上下线事件, 返回取消订阅函数;
+// 回调在事件发生的协程中同步执行, 不能阻塞, 也不能调用 Add、Remove、Rename
+func (m *Manager) Subscribe(fn func(Event)) func() {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	id := m.nextSub
+	m.nextSub++
+	m.subscribers[id] = fn
+	return func() {
+		m.subMu.Lock()
+		defer m.subMu.Unlock()
+		delete(m.subscribers, id)
+	}
+}
+
+func (m *Manager) publish(ev Event) {
+	m.subMu.Lock()
+	subs := make([]func(Event), 0, len(m.subscribers))
+	for _, fn := range m.subscribers {
+		subs = append(subs, fn)
+	}
+	m.subMu.Unlock()
+
+	for _, fn := range subs {
+		fn(ev)
+	}
+}
+
 func (m *Manager) Dump() {
 	m.Lock()
 	defer m.Unlock()
-	for addr, session := range m.addr2session {
-		logrus.Infof("Dump Addr: %s, Session: %v", addr, session.RemoteAddr().String())
+	for addr, entry := range m.addr2session {
+		logrus.Infof("Dump Addr: %s, Identity: %s, Session: %v, Streams: %d, RTT: %v",
+			addr, entry.identity, entry.session.RemoteAddr().String(), entry.session.NumStreams(), entry.rtt)
 	}
 }
@@ -0,0 +1,180 @@
+package common
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+func TestManagerEvictsClosedSession(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server, err := yamux.Server(c1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := yamux.Client(c2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	m := NewManager()
+	events := make(chan Event, 4)
+	unsubscribe := m.Subscribe(func(ev Event) { events <- ev })
+	defer unsubscribe()
+
+	m.Add("10.0.0.1", "alice", 0, false, server)
+	if ev := <-events; ev.Type != EventConnect || ev.Info.Identity != "alice" {
+		t.Fatalf("first event = %v %s, want connect alice", ev.Type, ev.Info.Identity)
+	}
+
+	client.Close()
+	select {
+	case ev := <-events:
+		if ev.Type != EventDisconnect || ev.Info.Addr != "10.0.0.1" {
+			t.Fatalf("event = %v %s, want disconnect 10.0.0.1", ev.Type, ev.Info.Addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not evicted")
+	}
+	if m.IsExist("10.0.0.1") {
+		t.Error("closed session still registered")
+	}
+}
+
+func TestManagerDrainAndRename(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server, err := yamux.Server(c1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := yamux.Client(c2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	m := NewManager()
+	m.Add("10.0.0.1", "alice", 0, false, server)
+
+	if err := m.Rename("10.0.0.1", "10.0.0.9"); err != nil {
+		t.Fatal(err)
+	}
+	if m.IsExist("10.0.0.1") || m.Get("10.0.0.9") != server {
+		t.Fatal("session was not moved to 10.0.0.9")
+	}
+
+	if err := m.Drain("10.0.0.9"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Get("10.0.0.9") != nil {
+		t.Error("draining session still offered for new streams")
+	}
+	select {
+	case <-server.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session was not closed after drain")
+	}
+}
+
+func TestManagerAliases(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server, err := yamux.Server(c1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := yamux.Client(c2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	m := NewManager()
+	m.Add("10.0.0.1", "alice", 0, false, server, "fd00::1")
+	if info, ok := m.Info("fd00::1"); !ok || info.Addr != "10.0.0.1" {
+		t.Fatalf("Info by alias = %+v, %v", info, ok)
+	}
+
+	// 改名别名时主地址不变, 旧别名失效
+	if err := m.Rename("fd00::1", "fd00::9"); err != nil {
+		t.Fatal(err)
+	}
+	if m.IsExist("fd00::1") {
+		t.Error("old alias still resolves")
+	}
+	info, ok := m.Info("fd00::9")
+	if !ok || info.Addr != "10.0.0.1" || len(info.Aliases) != 1 || info.Aliases[0] != "fd00::9" {
+		t.Fatalf("after alias rename = %+v, %v", info, ok)
+	}
+
+	// 改名主地址时别名跟随
+	if err := m.Rename("10.0.0.1", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := m.Info("fd00::9"); !ok || info.Addr != "10.0.0.2" {
+		t.Fatalf("alias after primary rename = %+v, %v", info, ok)
+	}
+
+	m.Remove("fd00::9")
+	if m.IsExist("10.0.0.2") || m.IsExist("fd00::9") {
+		t.Error("session still registered after Remove by alias")
+	}
+}
+
+func TestManagerEventOrder(t *testing.T) {
+	m := NewManager()
+	var mu sync.Mutex
+	online := false // 订阅者按事件维护的 10.0.0.1 状态
+	gone := make(chan *yamux.Session, 1)
+	unsubscribe := m.Subscribe(func(ev Event) {
+		if ev.Type == EventDisconnect {
+			// 处理较慢的订阅者, 期间同一地址重新上线
+			time.Sleep(20 * time.Millisecond)
+		}
+		mu.Lock()
+		online = ev.Type == EventConnect
+		mu.Unlock()
+		if ev.Type == EventDisconnect {
+			gone <- ev.Info.Session
+		}
+	})
+	defer unsubscribe()
+
+	pair := func() (*yamux.Session, *yamux.Session) {
+		c1, c2 := net.Pipe()
+		server, _ := yamux.Server(c1, nil)
+		client, _ := yamux.Client(c2, nil)
+		return server, client
+	}
+
+	old, oldClient := pair()
+	m.Add("10.0.0.1", "alice", 0, false, old)
+	for range 5 {
+		// 旧会话已从会话表移除、下线事件尚未处理完时重连
+		oldClient.Close()
+		for m.IsExist("10.0.0.1") {
+			time.Sleep(time.Millisecond)
+		}
+		server, client := pair()
+		m.Add("10.0.0.1", "alice", 0, false, server)
+		select {
+		case s := <-gone:
+			if s != old {
+				t.Fatal("disconnect event for the wrong session")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no disconnect event for the old session")
+		}
+		mu.Lock()
+		ok := online
+		mu.Unlock()
+		if !ok || !m.IsExist("10.0.0.1") {
+			t.Fatalf("subscriber online = %v, registered = %v", ok, m.IsExist("10.0.0.1"))
+		}
+		old, oldClient = server, client
+	}
+	oldClient.Close()
+}
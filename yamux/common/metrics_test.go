@@ -0,0 +1,50 @@
+package common
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	r := NewRegistry()
+	failures := r.NewCounter("test_failures_total", "Failures by reason.", "reason")
+	failures.With("auth").Inc()
+	failures.With("auth").Inc()
+	failures.With(`bad"quote`).Add(3)
+	r.NewGaugeFunc("test_sessions", "Connected sessions.", func() float64 { return 2 })
+	r.NewGaugeFunc("test_limit", "Limit,\nunbounded by default.", func() float64 { return math.Inf(1) })
+	r.NewCounterFunc("test_gets_total", "Gets.", func() float64 { return 7 })
+	latency := r.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	latency.With().Observe(0.05)
+	latency.With().Observe(0.5)
+	latency.With().Observe(5)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	got := rec.Body.String()
+
+	want := []string{
+		"# TYPE test_failures_total counter",
+		`test_failures_total{reason="auth"} 2`,
+		`test_failures_total{reason="bad\"quote"} 3`,
+		"# TYPE test_sessions gauge",
+		"test_sessions 2",
+		`# HELP test_limit Limit,\nunbounded by default.`,
+		"test_limit +Inf",
+		"# TYPE test_gets_total counter",
+		"test_gets_total 7",
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{le="0.1"} 1`,
+		`test_latency_seconds_bucket{le="1"} 2`,
+		`test_latency_seconds_bucket{le="+Inf"} 3`,
+		"test_latency_seconds_sum 5.55",
+		"test_latency_seconds_count 3",
+	}
+	for _, line := range want {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("missing %q in output:\n%s", line, got)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+var ErrStreamLimit = errors.New("stream limit exceeded")
+
+// Limits 客户端限速配置, 0 表示不限制; 上行指客户端发往服务端的方向
+type Limits struct {
+	UploadBPS         int64   `yaml:"upload_bps" json:"upload_bps"`     // 客户端全部流的上行字节/秒
+	DownloadBPS       int64   `yaml:"download_bps" json:"download_bps"` // 客户端全部流的下行字节/秒
+	StreamUploadBPS   int64   `yaml:"stream_upload_bps" json:"stream_upload_bps"`
+	StreamDownloadBPS int64   `yaml:"stream_download_bps" json:"stream_download_bps"`
+	MaxStreams        int     `yaml:"max_streams" json:"max_streams"`               // 并发流数
+	StreamsPerSecond  float64 `yaml:"streams_per_second" json:"streams_per_second"` // 每秒新建流数
+}
+
+func (l Limits) Validate() error {
+	if l.UploadBPS < 0 || l.DownloadBPS < 0 || l.StreamUploadBPS < 0 || l.StreamDownloadBPS < 0 ||
+		l.MaxStreams < 0 || l.StreamsPerSecond < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+func (l Limits) validate(v *validator) {
+	if err := l.Validate(); err != nil {
+		v.errorf("%v", err)
+	}
+}
+
+// minBurst 带宽令牌桶的最小容量, 保证单次写入不会被拆得过碎
+const minBurst = 32 << 10
+
+// clock 令牌桶的时间来源, 测试中替换为可控的时钟
+type clock struct {
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+var systemClock = &clock{now: time.Now, sleep: time.Sleep}
+
+// Bucket 令牌桶, rate 为每秒补充的令牌数, rate <= 0 时不限制
+type Bucket struct {
+	mu     sync.Mutex
+	clock  *clock
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate, burst float64) *Bucket {
+	return newBucket(systemClock, rate, burst)
+}
+
+func newBucket(c *clock, rate, burst float64) *Bucket {
+	b := &Bucket{clock: c, last: c.now()}
+	b.SetRate(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// bandwidthBucket 按每秒字节数构造令牌桶, 容量为一秒的流量
+func bandwidthBucket(c *clock, bps int64) *Bucket {
+	return newBucket(c, float64(bps), math.Max(float64(bps), minBurst))
+}
+
+// SetRate 运行时调整速率, 已积累的令牌不超过新容量
+func (b *Bucket) SetRate(rate, burst float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(b.clock.now())
+	b.rate = rate
+	b.burst = burst
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// Allow 有 n 个令牌时取走并返回 true, 不等待
+func (b *Bucket) Allow(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(b.clock.now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// refund 归还 Allow 取走的令牌
+func (b *Bucket) refund(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+n)
+	}
+}
+
+// allowAll 所有桶都有 n 个令牌时取走并返回 true, 否则不取走任何令牌
+func allowAll(n float64, buckets ...*Bucket) bool {
+	for i, b := range buckets {
+		if !b.Allow(n) {
+			for _, taken := range buckets[:i] {
+				taken.refund(n)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// reserve 取走 n 个令牌, 不足时透支, 返回需要等待的时间
+func (b *Bucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(b.clock.now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait 阻塞直到取得 n 个令牌
+func (b *Bucket) Wait(n int) {
+	if d := b.reserve(float64(n)); d > 0 {
+		b.clock.sleep(d)
+	}
+}
+
+// full 令牌已补满, 此时丢弃该桶与重新创建没有区别
+func (b *Bucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(b.clock.now())
+	return b.tokens >= b.burst
+}
+
+// pruneInterval 清理空闲客户端的最短间隔
+const pruneInterval = time.Minute
+
+// Limiter 按客户端身份限制带宽与流数量, 限额可在运行时修改并立即生效
+type Limiter struct {
+	mu        sync.Mutex
+	clock     *clock
+	defaults  Limits
+	overrides map[string]Limits
+	clients   map[string]*clientLimiter
+	lastPrune time.Time
+}
+
+type clientLimiter struct {
+	identity   string
+	limits     Limits
+	up, down   *Bucket
+	newStreams *Bucket
+	streams    map[*StreamLimiter]struct{}
+}
+
+// idle 没有进行中的流且令牌已补满, 可以删除
+func (c *clientLimiter) idle() bool {
+	return len(c.streams) == 0 && c.up.full() && c.down.full() && c.newStreams.full()
+}
+
+func NewLimiter(defaults Limits, overrides map[string]Limits) *Limiter {
+	l := &Limiter{
+		clock:     systemClock,
+		defaults:  defaults,
+		overrides: make(map[string]Limits, len(overrides)),
+		clients:   make(map[string]*clientLimiter),
+	}
+	for identity, lim := range overrides {
+		l.overrides[identity] = lim
+	}
+	return l
+}
+
+// Limits 返回 identity 当前生效的限额
+func (l *Limiter) Limits(identity string) Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limitsLocked(identity)
+}
+
+func (l *Limiter) limitsLocked(identity string) Limits {
+	if lim, ok := l.overrides[identity]; ok {
+		return lim
+	}
+	return l.defaults
+}
+
+// Defaults 返回默认限额与单独配置的客户端限额
+func (l *Limiter) Defaults() (Limits, map[string]Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	overrides := make(map[string]Limits, len(l.overrides))
+	for identity, lim := range l.overrides {
+		overrides[identity] = lim
+	}
+	return l.defaults, overrides
+}
+
+// SetDefault 修改默认限额, 没有单独配置的客户端立即生效
+func (l *Limiter) SetDefault(lim Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.defaults = lim
+	for identity := range l.clients {
+		l.applyLocked(identity)
+	}
+}
+
+// Set 单独配置 identity 的限额
+func (l *Limiter) Set(identity string, lim Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.overrides[identity] = lim
+	l.applyLocked(identity)
+}
+
+// Unset 删除 identity 的单独配置, 恢复默认限额
+func (l *Limiter) Unset(identity string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.overrides, identity)
+	l.applyLocked(identity)
+}
+
+// applyLocked 把限额同步到客户端及其进行中的流的令牌桶
+func (l *Limiter) applyLocked(identity string) {
+	c, ok := l.clients[identity]
+	if !ok {
+		return
+	}
+	lim := l.limitsLocked(identity)
+	c.limits = lim
+	c.up.SetRate(float64(lim.UploadBPS), math.Max(float64(lim.UploadBPS), minBurst))
+	c.down.SetRate(float64(lim.DownloadBPS), math.Max(float64(lim.DownloadBPS), minBurst))
+	c.newStreams.SetRate(lim.StreamsPerSecond, math.Max(1, math.Ceil(lim.StreamsPerSecond)))
+	for s := range c.streams {
+		s.up.SetRate(float64(lim.StreamUploadBPS), math.Max(float64(lim.StreamUploadBPS), minBurst))
+		s.down.SetRate(float64(lim.StreamDownloadBPS), math.Max(float64(lim.StreamDownloadBPS), minBurst))
+	}
+}
+
+// Open 为 identity 新建一条流, 超过并发数或新建速率时返回 ErrStreamLimit;
+// 成功时流结束后必须调用 Close
+func (l *Limiter) Open(identity string) (*StreamLimiter, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked()
+	c, ok := l.clients[identity]
+	if !ok {
+		lim := l.limitsLocked(identity)
+		c = &clientLimiter{
+			identity:   identity,
+			limits:     lim,
+			up:         bandwidthBucket(l.clock, lim.UploadBPS),
+			down:       bandwidthBucket(l.clock, lim.DownloadBPS),
+			newStreams: newBucket(l.clock, lim.StreamsPerSecond, math.Max(1, math.Ceil(lim.StreamsPerSecond))),
+			streams:    make(map[*StreamLimiter]struct{}),
+		}
+		l.clients[identity] = c
+	}
+
+	if c.limits.MaxStreams > 0 && len(c.streams) >= c.limits.MaxStreams {
+		return nil, ErrStreamLimit
+	}
+	if !c.newStreams.Allow(1) {
+		return nil, ErrStreamLimit
+	}
+	s := &StreamLimiter{
+		limiter: l,
+		client:  c,
+		up:      bandwidthBucket(l.clock, c.limits.StreamUploadBPS),
+		down:    bandwidthBucket(l.clock, c.limits.StreamDownloadBPS),
+	}
+	c.streams[s] = struct{}{}
+	return s, nil
+}
+
+// pruneLocked 定期删除关闭最后一条流时令牌尚未补满的客户端
+func (l *Limiter) pruneLocked() {
+	now := l.clock.now()
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for identity, c := range l.clients {
+		if c.idle() {
+			delete(l.clients, identity)
+		}
+	}
+}
+
+// StreamLimiter 单条流的限速器
+type StreamLimiter struct {
+	limiter  *Limiter
+	client   *clientLimiter
+	up, down *Bucket
+}
+
+// LimitIn 包装写入从客户端收到的数据的 Writer
+func (s *StreamLimiter) LimitIn(w io.Writer) io.Writer {
+	return &limitedWriter{w: w, clock: s.limiter.clock, buckets: []*Bucket{s.client.up, s.up}}
+}
+
+// LimitOut 包装写入发往客户端的数据的 Writer
+func (s *StreamLimiter) LimitOut(w io.Writer) io.Writer {
+	return &limitedWriter{w: w, clock: s.limiter.clock, buckets: []*Bucket{s.client.down, s.down}}
+}
+
+// AllowIn 不等待地为从客户端收到的 n 字节取令牌, 用于可以丢弃的数据报
+func (s *StreamLimiter) AllowIn(n int) bool {
+	return allowAll(float64(n), s.client.up, s.up)
+}
+
+// AllowOut 不等待地为发往客户端的 n 字节取令牌
+func (s *StreamLimiter) AllowOut(n int) bool {
+	return allowAll(float64(n), s.client.down, s.down)
+}
+
+// Close 释放并发流名额; 可重复调用. 客户端的最后一条流关闭且令牌已补满时
+// 删除该客户端, 否则留给之后的定期清理
+func (s *StreamLimiter) Close() {
+	l := s.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(s.client.streams, s)
+	if c, ok := l.clients[s.client.identity]; ok && c == s.client && c.idle() {
+		delete(l.clients, c.identity)
+	}
+}
+
+type limitedWriter struct {
+	w       io.Writer
+	clock   *clock
+	buckets []*Bucket
+}
+
+// Write 同时在所有桶上取令牌, 按等待最久的桶休眠
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	var wait time.Duration
+	for _, b := range l.buckets {
+		wait = max(wait, b.reserve(float64(len(p))))
+	}
+	if wait > 0 {
+		l.clock.sleep(wait)
+	}
+	return l.w.Write(p)
+}
@@ -0,0 +1,219 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock 可控的时钟, sleep 直接推进时间并累计休眠时长
+type fakeClock struct {
+	mu    sync.Mutex
+	t     time.Time
+	slept time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Unix(1700000000, 0)}
+}
+
+func (f *fakeClock) clock() *clock {
+	return &clock{now: f.now, sleep: f.sleep}
+}
+
+func (f *fakeClock) now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.t
+}
+
+func (f *fakeClock) sleep(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.t = f.t.Add(d)
+	f.slept += d
+}
+
+// takeSlept 返回并清零累计的休眠时长
+func (f *fakeClock) takeSlept() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.slept
+	f.slept = 0
+	return d
+}
+
+func TestBucketWait(t *testing.T) {
+	fc := newFakeClock()
+	b := newBucket(fc.clock(), 100<<10, 100<<10)
+	b.Wait(100 << 10) // 初始令牌
+	if d := fc.takeSlept(); d != 0 {
+		t.Errorf("initial tokens: waited %v", d)
+	}
+	b.Wait(50 << 10) // 透支, 需要 0.5s
+	if d := fc.takeSlept(); d != 500*time.Millisecond {
+		t.Errorf("waited %v, want 500ms", d)
+	}
+
+	unlimited := newBucket(fc.clock(), 0, 0)
+	unlimited.Wait(1 << 30)
+	if d := fc.takeSlept(); d != 0 {
+		t.Errorf("unlimited bucket waited %v", d)
+	}
+}
+
+func TestLimiterStreams(t *testing.T) {
+	l := NewLimiter(Limits{MaxStreams: 2}, map[string]Limits{"bob": {StreamsPerSecond: 1}})
+
+	a1, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Open("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Open("alice"); !errors.Is(err, ErrStreamLimit) {
+		t.Fatalf("third stream: err = %v, want ErrStreamLimit", err)
+	}
+	a1.Close()
+	a1.Close()
+	if _, err := l.Open("alice"); err != nil {
+		t.Fatalf("stream after close: %v", err)
+	}
+
+	// bob 有单独配置, 不受默认并发数限制, 但每秒只能新建一条流
+	if _, err := l.Open("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Open("bob"); !errors.Is(err, ErrStreamLimit) {
+		t.Fatalf("second bob stream: err = %v, want ErrStreamLimit", err)
+	}
+
+	// 运行时修改立即生效
+	l.Set("alice", Limits{})
+	if _, err := l.Open("alice"); err != nil {
+		t.Fatalf("alice after lifting limits: %v", err)
+	}
+}
+
+func TestLimiterBandwidth(t *testing.T) {
+	fc := newFakeClock()
+	l := NewLimiter(Limits{DownloadBPS: 64 << 10, StreamDownloadBPS: 64 << 10}, nil)
+	l.clock = fc.clock()
+	s, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var buf bytes.Buffer
+	w := s.LimitOut(&buf)
+	w.Write(make([]byte, 64<<10)) // 初始令牌
+	if d := fc.takeSlept(); d != 0 {
+		t.Errorf("initial tokens: waited %v", d)
+	}
+	// 客户端与流的桶都透支 0.5s, 按较长的等待一次休眠而不是相加
+	w.Write(make([]byte, 32<<10))
+	if d := fc.takeSlept(); d != 500*time.Millisecond {
+		t.Errorf("96KiB at 64KiB/s waited %v, want 500ms", d)
+	}
+	if buf.Len() != 96<<10 {
+		t.Errorf("wrote %d bytes", buf.Len())
+	}
+
+	// 流的速率更低时按流的桶等待
+	l.SetDefault(Limits{DownloadBPS: 64 << 10, StreamDownloadBPS: 32 << 10})
+	fc.sleep(time.Second)
+	fc.takeSlept()
+	w.Write(make([]byte, 64<<10))
+	if d := fc.takeSlept(); d != time.Second {
+		t.Errorf("64KiB at 32KiB/s per stream waited %v, want 1s", d)
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	fc := newFakeClock()
+	l := NewLimiter(Limits{}, map[string]Limits{"alice": {StreamsPerSecond: 1}})
+	l.clock = fc.clock()
+	clients := func() int {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.clients)
+	}
+
+	// 不限速的客户端关闭最后一条流后立即删除
+	bob, err := l.Open("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Close()
+	if n := clients(); n != 0 {
+		t.Fatalf("%d clients after bob's last stream closed", n)
+	}
+
+	// 新建流的令牌尚未补满时保留, 否则关闭再打开就能绕过速率限制
+	alice, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Close()
+	if _, err := l.Open("alice"); !errors.Is(err, ErrStreamLimit) {
+		t.Fatalf("reopen within a second: err = %v, want ErrStreamLimit", err)
+	}
+	if n := clients(); n != 1 {
+		t.Fatalf("%d clients, want alice kept", n)
+	}
+
+	// 之后的定期清理删除 alice
+	fc.sleep(pruneInterval)
+	bob, err = l.Open("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	l.mu.Lock()
+	_, ok := l.clients["alice"]
+	l.mu.Unlock()
+	if ok || clients() != 1 {
+		t.Errorf("alice not pruned, %d clients", clients())
+	}
+}
+
+func TestStreamLimiterAllow(t *testing.T) {
+	l := NewLimiter(Limits{DownloadBPS: 64 << 10, StreamDownloadBPS: 32 << 10}, nil)
+	l.clock = newFakeClock().clock()
+	s1, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	if !s1.AllowOut(32 << 10) {
+		t.Fatal("first datagram denied")
+	}
+	// 流的令牌不足, 不应消耗客户端的令牌
+	if s1.AllowOut(32 << 10) {
+		t.Fatal("stream bucket exceeded")
+	}
+	if !s2.AllowOut(32 << 10) {
+		t.Fatal("client tokens taken by a denied datagram")
+	}
+	s3, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Close()
+	if s3.AllowOut(32 << 10) {
+		t.Fatal("client bucket exceeded")
+	}
+	if !s1.AllowIn(1 << 20) {
+		t.Fatal("upload is not limited")
+	}
+}
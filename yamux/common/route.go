@@ -0,0 +1,214 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrNoRoute = errors.New("no route to destination")
+
+var loopback = netip.MustParsePrefix("127.0.0.1/32")
+
+// Route 目的网段 -> 客户端会话(以虚拟地址标识)
+//
+// MapTo 非空时为映射模式: 目的地址的网络部分被替换为 MapTo,
+// 主机部分保持不变, 例如 10.0.2.0/24 映射到客户端侧的 192.168.1.0/24.
+type Route struct {
+	Prefix netip.Prefix
+	Target string
+	MapTo  netip.Prefix
+}
+
+func (r Route) String() string {
+	if r.MapTo.IsValid() {
+		return fmt.Sprintf("%s via %s map %s", r.Prefix, r.Target, r.MapTo)
+	}
+	return fmt.Sprintf("%s via %s", r.Prefix, r.Target)
+}
+
+// Rewrite 返回客户端侧实际要连接的地址
+func (r Route) Rewrite(addr netip.Addr) netip.Addr {
+	if !r.MapTo.IsValid() {
+		return addr
+	}
+	src := addr.Unmap().AsSlice()
+	dst := r.MapTo.Addr().AsSlice()
+	if len(src) != len(dst) {
+		return addr
+	}
+	bits := r.MapTo.Bits()
+	for i := range dst {
+		var mask byte
+		switch {
+		case bits >= (i+1)*8:
+			mask = 0xff
+		case bits > i*8:
+			mask = ^byte(0xff >> (bits - i*8))
+		}
+		dst[i] = dst[i]&mask | src[i]&^mask
+	}
+	out, _ := netip.AddrFromSlice(dst)
+	return out
+}
+
+func (r Route) validate() error {
+	if !r.MapTo.IsValid() {
+		return nil
+	}
+	if r.Prefix.Addr().Is4() != r.MapTo.Addr().Is4() || r.Prefix.Bits() != r.MapTo.Bits() {
+		return fmt.Errorf("route %s: mapped prefix must have the same family and length", r)
+	}
+	return nil
+}
+
+// ParseRoute 解析 "192.168.1.0/24=10.0.0.2" 形式的路由,
+// 映射模式写作 "10.0.2.0/24=10.0.0.2@192.168.1.0/24"
+func ParseRoute(s string) (Route, error) {
+	dst, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return Route{}, fmt.Errorf("invalid route %q, want CIDR=VIP[@CIDR]", s)
+	}
+	prefix, err := parsePrefix(strings.TrimSpace(dst))
+	if err != nil {
+		return Route{}, err
+	}
+	route := Route{Prefix: prefix}
+
+	target, mapTo, mapped := strings.Cut(target, "@")
+	route.Target = strings.TrimSpace(target)
+	if _, err := netip.ParseAddr(route.Target); err != nil {
+		return Route{}, fmt.Errorf("invalid route target %q: %v", route.Target, err)
+	}
+	if mapped {
+		if route.MapTo, err = parsePrefix(strings.TrimSpace(mapTo)); err != nil {
+			return Route{}, err
+		}
+	}
+	if err := route.validate(); err != nil {
+		return Route{}, err
+	}
+	return route, nil
+}
+
+// parsePrefix 同时接受 CIDR 与单个地址
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// RouteTable 按最长前缀匹配查找目的地址所属的客户端
+type RouteTable struct {
+	sync.RWMutex
+	routes []Route // 按前缀长度降序
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{}
+}
+
+// Add 添加或替换一条路由
+func (t *RouteTable) Add(r Route) {
+	t.Lock()
+	defer t.Unlock()
+	r.Prefix = r.Prefix.Masked()
+	for i := range t.routes {
+		if t.routes[i].Prefix == r.Prefix {
+			t.routes[i] = r
+			return
+		}
+	}
+	t.routes = append(t.routes, r)
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		return t.routes[i].Prefix.Bits() > t.routes[j].Prefix.Bits()
+	})
+}
+
+// AddHost 为虚拟地址添加一条主机路由, 访问虚拟地址即访问客户端本机
+func (t *RouteTable) AddHost(vip string) error {
+	return t.AddHostVia(vip, vip)
+}
+
+// AddHostVia 为会话 vip 的另一个虚拟地址 addr 添加主机路由, 用于双栈会话的别名
+func (t *RouteTable) AddHostVia(addr, vip string) error {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return err
+	}
+	route := Route{Prefix: netip.PrefixFrom(ip, ip.BitLen()), Target: vip}
+	if ip.Is4() {
+		route.MapTo = loopback
+	} else {
+		route.MapTo = netip.PrefixFrom(netip.IPv6Loopback(), 128)
+	}
+	t.Add(route)
+	return nil
+}
+
+func (t *RouteTable) Remove(prefix netip.Prefix) {
+	t.Lock()
+	defer t.Unlock()
+	prefix = prefix.Masked()
+	for i := range t.routes {
+		if t.routes[i].Prefix == prefix {
+			t.routes = append(t.routes[:i], t.routes[i+1:]...)
+			return
+		}
+	}
+}
+
+// RemoveTarget 删除指向某个客户端的全部路由
+func (t *RouteTable) RemoveTarget(target string) {
+	t.Lock()
+	defer t.Unlock()
+	routes := t.routes[:0]
+	for _, r := range t.routes {
+		if r.Target != target {
+			routes = append(routes, r)
+		}
+	}
+	t.routes = routes
+}
+
+// Retarget 把指向 oldTarget 的路由改为指向 newTarget, 用于客户端更换虚拟地址
+func (t *RouteTable) Retarget(oldTarget, newTarget string) {
+	t.Lock()
+	defer t.Unlock()
+	for i := range t.routes {
+		if t.routes[i].Target == oldTarget {
+			t.routes[i].Target = newTarget
+		}
+	}
+}
+
+// Lookup 返回与 addr 匹配的最长前缀路由
+func (t *RouteTable) Lookup(addr netip.Addr) (Route, error) {
+	addr = addr.Unmap()
+	t.RLock()
+	defer t.RUnlock()
+	for _, r := range t.routes {
+		if r.Prefix.Contains(addr) {
+			return r, nil
+		}
+	}
+	return Route{}, ErrNoRoute
+}
+
+func (t *RouteTable) Routes() []Route {
+	t.RLock()
+	defer t.RUnlock()
+	return append([]Route(nil), t.routes...)
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRouteTableLongestPrefix(t *testing.T) {
+	table := NewRouteTable()
+	for _, s := range []string{
+		"10.0.0.0/8=10.0.0.1",
+		"192.168.1.0/24=10.0.0.2",
+		"192.168.1.128/25=10.0.0.3",
+	} {
+		r, err := ParseRoute(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table.Add(r)
+	}
+	if err := table.AddHost("10.0.0.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"10.0.0.5":      "10.0.0.5",
+		"10.0.0.6":      "10.0.0.1",
+		"192.168.1.10":  "10.0.0.2",
+		"192.168.1.200": "10.0.0.3",
+	}
+	for dst, want := range cases {
+		r, err := table.Lookup(netip.MustParseAddr(dst))
+		if err != nil {
+			t.Fatalf("lookup %s: %v", dst, err)
+		}
+		if r.Target != want {
+			t.Errorf("lookup %s = %s, want %s", dst, r.Target, want)
+		}
+	}
+
+	if _, err := table.Lookup(netip.MustParseAddr("172.16.0.1")); err != ErrNoRoute {
+		t.Errorf("lookup unrouted address: err = %v, want ErrNoRoute", err)
+	}
+
+	table.RemoveTarget("10.0.0.3")
+	r, _ := table.Lookup(netip.MustParseAddr("192.168.1.200"))
+	if r.Target != "10.0.0.2" {
+		t.Errorf("after remove, lookup = %s, want 10.0.0.2", r.Target)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	for _, s := range []string{"10.0.0.0/8", "bad=10.0.0.1", "10.0.0.0/8=host"} {
+		if _, err := ParseRoute(s); err == nil {
+			t.Errorf("ParseRoute(%q) succeeded, want error", s)
+		}
+	}
+	r, err := ParseRoute("10.1.2.3=10.0.0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Prefix.Bits() != 32 {
+		t.Errorf("bare address prefix bits = %d, want 32", r.Prefix.Bits())
+	}
+}
+
+func TestRouteRewrite(t *testing.T) {
+	r, err := ParseRoute("10.0.2.0/24=10.0.0.2@192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Rewrite(netip.MustParseAddr("10.0.2.37")); got.String() != "192.168.1.37" {
+		t.Errorf("Rewrite = %s, want 192.168.1.37", got)
+	}
+
+	r, _ = ParseRoute("10.8.0.0/12=10.0.0.2@172.16.0.0/12")
+	if got := r.Rewrite(netip.MustParseAddr("10.9.1.2")); got.String() != "172.25.1.2" {
+		t.Errorf("Rewrite = %s, want 172.25.1.2", got)
+	}
+
+	if _, err := ParseRoute("10.0.2.0/24=10.0.0.2@192.168.0.0/16"); err == nil {
+		t.Error("mismatched mapping length accepted")
+	}
+
+	table := NewRouteTable()
+	table.AddHost("10.0.0.4")
+	r, _ = table.Lookup(netip.MustParseAddr("10.0.0.4"))
+	if got := r.Rewrite(netip.MustParseAddr("10.0.0.4")); got.String() != "127.0.0.1" {
+		t.Errorf("host route Rewrite = %s, want 127.0.0.1", got)
+	}
+}
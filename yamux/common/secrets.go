@@ -0,0 +1,155 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// ClientSecret 客户端密钥配置
+type ClientSecret struct {
+	Identity string `yaml:"identity"`
+	Secret   string `yaml:"secret"`
+	Revoked  bool   `yaml:"revoked"`
+}
+
+type secretsFile struct {
+	Clients []ClientSecret `yaml:"clients"`
+}
+
+// SecretStore 从配置文件加载各客户端密钥, 文件变化后可热加载,
+// 用于吊销或轮换密钥而无需重启服务
+//
+//	clients:
+//	  - identity: office-gw
+//	    secret: "xxxxxxxx"
+//	  - identity: lost-laptop
+//	    secret: "yyyyyyyy"
+//	    revoked: true
+type SecretStore struct {
+	sync.RWMutex
+	path    string
+	modTime time.Time
+	clients map[string]ClientSecret
+}
+
+func LoadSecretStore(path string) (*SecretStore, error) {
+	s := &SecretStore{path: path}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewStaticSecretStore 由内存中的配置构造, 不支持热加载
+func NewStaticSecretStore(clients []ClientSecret) (*SecretStore, error) {
+	s := &SecretStore{}
+	if err := s.set(clients); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SecretStore) set(clients []ClientSecret) error {
+	m := make(map[string]ClientSecret, len(clients))
+	for _, c := range clients {
+		if c.Identity == "" || len(c.Identity) > MaxIdentityLen {
+			return fmt.Errorf("invalid identity %q", c.Identity)
+		}
+		if c.Secret == "" {
+			return fmt.Errorf("empty secret for %q", c.Identity)
+		}
+		if _, ok := m[c.Identity]; ok {
+			return fmt.Errorf("duplicate identity %q", c.Identity)
+		}
+		m[c.Identity] = c
+	}
+
+	s.Lock()
+	s.clients = m
+	s.Unlock()
+	return nil
+}
+
+// Reload 文件修改时间变化时重新加载, 返回是否发生了加载;
+// 加载失败时保留旧配置
+func (s *SecretStore) Reload() (bool, error) {
+	if s.path == "" {
+		return false, nil
+	}
+	st, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.RLock()
+	unchanged := st.ModTime().Equal(s.modTime)
+	s.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	var f secretsFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return false, fmt.Errorf("%s: %v", s.path, err)
+	}
+	if err := s.set(f.Clients); err != nil {
+		return false, fmt.Errorf("%s: %v", s.path, err)
+	}
+
+	s.Lock()
+	s.modTime = st.ModTime()
+	s.Unlock()
+	return true, nil
+}
+
+// Watch 定期检查文件变化, 重新加载后调用 onReload
+func (s *SecretStore) Watch(ctx context.Context, interval time.Duration, onReload func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := s.Reload()
+			if err != nil {
+				logrus.Errorf("重新加载密钥文件失败: %v", err)
+				continue
+			}
+			if reloaded {
+				logrus.Infof("Secrets reloaded from %s", s.path)
+				if onReload != nil {
+					onReload()
+				}
+			}
+		}
+	}
+}
+
+func (s *SecretStore) Secret(identity string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	c, ok := s.clients[identity]
+	if !ok {
+		return nil, ErrUnknownIdentity
+	}
+	if c.Revoked {
+		return nil, ErrRevoked
+	}
+	return []byte(c.Secret), nil
+}
+
+// Allowed 身份存在且未被吊销
+func (s *SecretStore) Allowed(identity string) bool {
+	_, err := s.Secret(identity)
+	return err == nil
+}
@@ -1,15 +1,16 @@
 package common
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"strconv"
-	"strings"
-	"unicode"
+	"syscall"
+	"time"
 )
 
 const Zero = 0x0
@@ -22,8 +23,10 @@ const (
 const (
 	// NoAuthenticationRequired 不需要认证
 	NoAuthenticationRequired = 0x00
-	// AccountPasswordAuthentication 账号密码认证
+	// AccountPasswordAuthentication 账号密码认证 (RFC 1929)
 	AccountPasswordAuthentication = 0x02
+	// NoAcceptableMethods 服务端不接受客户端提供的任何方法
+	NoAcceptableMethods = 0xff
 )
 
 // 命令
@@ -46,182 +49,351 @@ const (
 	IPV6 = 0x04
 )
 
-type AuthPackage struct {
-	methodsCount uint8
-	methods      []byte
+// userPassVersion RFC 1929 子协商版本
+const userPassVersion = 0x01
+
+var (
+	ErrNoAcceptableMethod = errors.New("socks5: no acceptable authentication method")
+	ErrSocksAuthFailed    = errors.New("socks5: username/password authentication failed")
+)
+
+// ReplyCode 应答中的 REP 字段
+type ReplyCode byte
+
+const (
+	ReplySucceeded ReplyCode = iota
+	ReplyGeneralFailure
+	ReplyNotAllowed
+	ReplyNetworkUnreachable
+	ReplyHostUnreachable
+	ReplyConnectionRefused
+	ReplyTTLExpired
+	ReplyCommandNotSupported
+	ReplyAddressNotSupported
+)
+
+func (c ReplyCode) String() string {
+	switch c {
+	case ReplySucceeded:
+		return "succeeded"
+	case ReplyGeneralFailure:
+		return "general SOCKS server failure"
+	case ReplyNotAllowed:
+		return "connection not allowed by ruleset"
+	case ReplyNetworkUnreachable:
+		return "network unreachable"
+	case ReplyHostUnreachable:
+		return "host unreachable"
+	case ReplyConnectionRefused:
+		return "connection refused"
+	case ReplyTTLExpired:
+		return "TTL expired"
+	case ReplyCommandNotSupported:
+		return "command not supported"
+	case ReplyAddressNotSupported:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown reply %#x", byte(c))
+	}
 }
 
-func (t *AuthPackage) toData() []byte {
-	return append([]byte{Version, t.methodsCount}, t.methods...)
+// ReplyError 服务端返回的失败应答; 可用 errors.Is 与对应的 syscall 错误比较,
+// 例如 ReplyConnectionRefused 对应 syscall.ECONNREFUSED
+type ReplyError struct {
+	Code ReplyCode
 }
-func (t *AuthPackage) addMethod(methods ...uint8) {
-	t.methods = append(t.methods, methods...)
-	t.methodsCount += uint8(len(methods))
+
+func (e *ReplyError) Error() string {
+	return "socks5: " + e.Code.String()
 }
 
-type ClientRequest struct {
-	command     uint8
-	RSV         uint8
-	addressType uint8
-	addr        []byte
+func (e *ReplyError) Unwrap() error {
+	switch e.Code {
+	case ReplyNetworkUnreachable:
+		return syscall.ENETUNREACH
+	case ReplyHostUnreachable:
+		return syscall.EHOSTUNREACH
+	case ReplyConnectionRefused:
+		return syscall.ECONNREFUSED
+	case ReplyTTLExpired:
+		return syscall.ETIMEDOUT
+	default:
+		return nil
+	}
 }
 
-func Auth(conn net.Conn) error {
-	//组织发送支持的认证方法
-	authPackage := AuthPackage{}
+// Timeout 实现 net.Error
+func (e *ReplyError) Timeout() bool { return e.Code == ReplyTTLExpired }
 
-	//免密
-	authPackage.addMethod(NoAuthenticationRequired)
-	_, err := conn.Write(authPackage.toData())
-	if err != nil {
-		return err
+// Temporary 实现 net.Error
+func (e *ReplyError) Temporary() bool { return false }
+
+// SocksCredentials RFC 1929 用户名与密码, 长度均为 1-255 字节
+type SocksCredentials struct {
+	Username string
+	Password string
+}
+
+// SocksAddr SOCKS5 地址, Host 为 IP 地址或域名
+type SocksAddr struct {
+	Host string
+	Port uint16
+}
+
+func (a SocksAddr) Network() string { return "socks5" }
+
+func (a SocksAddr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(int(a.Port)))
+}
+
+// appendAddr 按 SOCKS5 格式编码 ATYP|ADDR|PORT
+func appendAddr(b []byte, host string, port uint16) ([]byte, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() || ip.Is4In6() {
+			a := ip.Unmap().As4()
+			b = append(append(b, IPV4), a[:]...)
+		} else {
+			a := ip.As16()
+			b = append(append(b, IPV6), a[:]...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("socks5: invalid host %q", host)
+		}
+		b = append(append(b, Com, byte(len(host))), host...)
 	}
-	data := make([]byte, 2)
-	l, err := conn.Read(data)
-	if err != nil {
-		return err
+	return binary.BigEndian.AppendUint16(b, port), nil
+}
+
+// readAddr 读取 SOCKS5 格式的 ATYP|ADDR|PORT
+func readAddr(r io.Reader) (string, uint16, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
 	}
-	if l != 2 {
-		return errors.New("返回数据有误非两个字节")
+	var host string
+	switch atyp[0] {
+	case IPV4:
+		var a [4]byte
+		if _, err := io.ReadFull(r, a[:]); err != nil {
+			return "", 0, err
+		}
+		host = netip.AddrFrom4(a).String()
+	case IPV6:
+		var a [16]byte
+		if _, err := io.ReadFull(r, a[:]); err != nil {
+			return "", 0, err
+		}
+		host = netip.AddrFrom16(a).String()
+	case Com:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, fmt.Errorf("socks5: unsupported address type %d", atyp[0])
 	}
-	if data[0] != Version {
-		return errors.New("当前协议Socks5与服务端协议不匹配")
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
 	}
+	return host, binary.BigEndian.Uint16(port[:]), nil
+}
 
-	switch data[1] {
+// Negotiate 协商认证方法, auth 不为空时同时提供账号密码认证
+func Negotiate(conn io.ReadWriter, auth *SocksCredentials) error {
+	methods := []byte{NoAuthenticationRequired}
+	if auth != nil {
+		if len(auth.Username) == 0 || len(auth.Username) > 255 || len(auth.Password) == 0 || len(auth.Password) > 255 {
+			return errors.New("socks5: username and password must be 1-255 bytes")
+		}
+		methods = append(methods, AccountPasswordAuthentication)
+	}
+	if _, err := conn.Write(append([]byte{Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != Version {
+		return fmt.Errorf("socks5: unexpected version %d", resp[0])
+	}
+	switch resp[1] {
 	case NoAuthenticationRequired:
 		return nil
+	case AccountPasswordAuthentication:
+		if auth == nil {
+			return fmt.Errorf("socks5: server selected unoffered method %d", resp[1])
+		}
+		return userPassAuth(conn, auth)
+	case NoAcceptableMethods:
+		return ErrNoAcceptableMethod
+	default:
+		return fmt.Errorf("socks5: server selected unoffered method %d", resp[1])
 	}
-
-	return errors.New("非认证模式认证失败")
 }
 
-// 向服务器发送连接请求
-func Requisition(conn net.Conn, host string, port uint16, cmd uint8) error {
-	Type, addr, err := addressResolution(host)
-	if err != nil {
+// userPassAuth RFC 1929 子协商
+func userPassAuth(conn io.ReadWriter, auth *SocksCredentials) error {
+	req := []byte{userPassVersion, byte(len(auth.Username))}
+	req = append(req, auth.Username...)
+	req = append(req, byte(len(auth.Password)))
+	req = append(req, auth.Password...)
+	if _, err := conn.Write(req); err != nil {
 		return err
 	}
-	buffer := bytes.Buffer{}
-	buffer.Write([]byte{Version, cmd, Zero, Type})
-	buffer.Write(addr)
-	//写入端口
-	buffer.Write(portToBytes(port))
-	_, err = conn.Write(buffer.Bytes())
-	if err != nil {
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
 		return err
 	}
+	if resp[0] != userPassVersion {
+		return fmt.Errorf("socks5: unexpected auth version %d", resp[0])
+	}
+	if resp[1] != 0x00 {
+		return ErrSocksAuthFailed
+	}
+	return nil
+}
 
-	// 读取响应，此处粗暴多读一点
-	resp := make([]byte, 10)
-	_, err = io.ReadFull(conn, resp)
+// Request 发送命令并读取应答, 返回应答中的 BND.ADDR;
+// 服务端拒绝时返回 *ReplyError
+func Request(conn io.ReadWriter, cmd byte, host string, port uint16) (SocksAddr, error) {
+	req, err := appendAddr([]byte{Version, cmd, Zero}, host, port)
 	if err != nil {
-		return err
+		return SocksAddr{}, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return SocksAddr{}, err
 	}
+	return ReadReply(conn)
+}
 
-	// 检查响应是否正确
+// ReadReply 读取一个应答; BIND 命令的第二个应答也用它读取
+func ReadReply(r io.Reader) (SocksAddr, error) {
+	var resp [3]byte
+	if _, err := io.ReadFull(r, resp[:]); err != nil {
+		return SocksAddr{}, err
+	}
 	if resp[0] != Version {
-		return errors.New("服务器响应的协议版本与期望不符")
+		return SocksAddr{}, fmt.Errorf("socks5: unexpected version %d", resp[0])
 	}
-	if resp[1] != 0x00 {
-		return errors.New("服务器拒绝连接")
+	host, port, err := readAddr(r)
+	if code := ReplyCode(resp[1]); code != ReplySucceeded {
+		return SocksAddr{}, &ReplyError{Code: code}
 	}
+	if err != nil {
+		return SocksAddr{}, err
+	}
+	return SocksAddr{Host: host, Port: port}, nil
+}
 
-	return nil
+// Auth 以免认证方式完成方法协商, 用于隧道内的 SOCKS5 服务
+func Auth(conn net.Conn) error {
+	return Negotiate(conn, nil)
 }
 
-func addressResolution(host string) (uint8, []byte, error) {
-	var Type uint8
-	addr := make([]byte, 0)
-	if strings.Contains(host, ":") {
-		Type = IPV6
-		//ipv6 地址转16位uint
-		if strings.Contains(host, "[") {
-			host = host[1 : len(host)-1]
-		}
-		split := strings.Split(host, ":")
-		for _, s := range split {
-			if s == "" {
-				addr = append(addr, Zero)
-				continue
-			}
-			num, err := strconv.ParseUint(s, 16, 16)
-			if err != nil {
-				return Zero, nil, err
-			}
-			bytes := make([]byte, 2)
-			binary.BigEndian.PutUint16(bytes, uint16(num))
-			addr = append(addr, bytes...)
-		}
+// Requisition 向服务器发送请求并检查应答
+func Requisition(conn net.Conn, host string, port uint16, cmd uint8) error {
+	_, err := Request(conn, cmd, host, port)
+	return err
+}
+
+// ContextDialer 与 golang.org/x/net/proxy.ContextDialer 相同
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// SocksDialer 经由 SOCKS5 代理建立 TCP 连接
+type SocksDialer struct {
+	ProxyNetwork string // 通常为 "tcp"
+	ProxyAddress string
+	Auth         *SocksCredentials // 为空时只使用免认证
+
+	// Forward 用于连接代理服务器, 为空时使用 net.Dialer
+	Forward ContextDialer
+}
+
+func NewSocksDialer(network, address string, auth *SocksCredentials) *SocksDialer {
+	return &SocksDialer{ProxyNetwork: network, ProxyAddress: address, Auth: auth}
+}
+
+func (d *SocksDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext 连接代理并发送 CONNECT, ctx 同时限制握手阶段
+func (d *SocksDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("socks5: unsupported network %q", network)}
 	}
-	runes := []rune(host)
-	if Type == Zero && unicode.IsNumber(runes[len(runes)-1]) {
-		Type = IPV4
-		split := strings.Split(host, ".")
-		for _, s := range split {
-			num, err := strconv.ParseUint(s, 10, 16)
-			if err != nil {
-				return Zero, nil, err
-			}
-			addr = append(addr, uint8(num))
-		}
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
 	}
-	if Type == Zero && unicode.IsLetter(runes[len(runes)-1]) {
-		Type = Com
-		addr = append(addr, uint8(len(host)))
-		addr = append(addr, []byte(host)...)
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
 	}
-	if Type == Zero {
-		return Zero, nil, errors.New("地址类型错误")
+	if err := d.handshake(ctx, conn, func() error {
+		_, err := Request(conn, Connect, host, port)
+		return err
+	}); err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Source: conn.LocalAddr(), Addr: SocksAddr{host, port}, Err: err}
 	}
-	return Type, addr, nil
+	return conn, nil
 }
 
-// 从[]byte 数据中解析主机地址和端口
-func addressResolutionFormByteArray(ipdata []byte, Type uint8) (string, error) {
-	if len(ipdata) < 6 || Type == Zero {
-		return "", errors.New(fmt.Sprintf("解析地址数据有误,%v %x", ipdata, Type))
+func (d *SocksDialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
 	}
-	addr := ""
-	var portBytes []byte
-	switch Type {
-	case IPV4:
-		for i, b := range ipdata[:4] {
-			addr += strconv.Itoa(int(b))
-			if i != 3 {
-				addr += "."
-			}
-		}
-		portBytes = ipdata[4:6]
-	case IPV6:
-		if len(ipdata) < 18 {
-			return "", errors.New("数据长度不足18字节")
-		}
-		for i := 0; i < 16; i += 2 {
-			u := binary.BigEndian.Uint16(ipdata[i : i+2])
-			s := strconv.FormatUint(uint64(u), 16)
-			addr += s
-			if i != 14 {
-				addr += ":"
-			}
-		}
-		portBytes = ipdata[16:18]
-	case Com:
-		l := ipdata[0]
-		if int(l)+3 < len(ipdata) {
-			return "", errors.New("数据长度不足")
+	network := d.ProxyNetwork
+	if network == "" {
+		network = "tcp"
+	}
+	return forward.DialContext(ctx, network, d.ProxyAddress)
+}
+
+// handshake 在 ctx 的期限内完成认证与 fn 中的请求, ctx 取消时中断阻塞的读写
+func (d *SocksDialer) handshake(ctx context.Context, conn net.Conn, fn func() error) (err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer func() {
+		// ctx 结束后被中断的读写返回超时错误, 改为报告 ctx 的错误
+		if !stop() || (err != nil && ctx.Err() != nil) {
+			err = ctx.Err()
 		}
-		bytes := ipdata[1 : int(l)+1]
-		addr += string(bytes)
-		portBytes = ipdata[int(l)+1 : int(l)+3]
+	}()
+
+	if err := Negotiate(conn, d.Auth); err != nil {
+		return err
 	}
-	addr += ":" + strconv.Itoa(int(binary.BigEndian.Uint16(portBytes)))
-	return addr, nil
+	return fn()
 }
 
-func portToBytes(port uint16) []byte {
-	//写入端口
-	buf := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf, port)
-	return buf
+func splitHostPort(address string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return host, uint16(port), nil
 }
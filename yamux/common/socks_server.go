@@ -0,0 +1,269 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/armon/go-socks5"
+)
+
+// maxAssociateDests 每个 UDP 关联缓存的目的地址数, 超过时清空重新解析
+const maxAssociateDests = 256
+
+// SocksServer 客户端内置的 SOCKS5 服务. armon/go-socks5 不支持 UDP ASSOCIATE,
+// 这里先完成方法协商并读取请求, UDP ASSOCIATE 自行处理, 其他请求连同已读取的字节
+// 交还 go-socks5.
+type SocksServer struct {
+	socks *socks5.Server
+}
+
+func NewSocksServer() (*SocksServer, error) {
+	s, err := NewSimpleSocksProxyServer()
+	if err != nil {
+		return nil, err
+	}
+	return &SocksServer{socks: s}, nil
+}
+
+// ServeConn 处理一个 SOCKS5 连接
+func (s *SocksServer) ServeConn(conn net.Conn) error {
+	var consumed bytes.Buffer
+	r := io.TeeReader(conn, &consumed)
+
+	// 只在客户端接受无认证时接管, 否则由 go-socks5 给出应答
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		conn.Close()
+		return err
+	}
+	if hdr[0] != Version {
+		return s.replay(conn, consumed.Bytes(), 0)
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		conn.Close()
+		return err
+	}
+	if bytes.IndexByte(methods, NoAuthenticationRequired) < 0 {
+		return s.replay(conn, consumed.Bytes(), 0)
+	}
+	if _, err := conn.Write([]byte{Version, NoAuthenticationRequired}); err != nil {
+		conn.Close()
+		return err
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(r, req); err != nil {
+		conn.Close()
+		return err
+	}
+	if req[0] != Version || req[1] != UDP {
+		// go-socks5 会再次应答方法协商, 丢弃这 2 字节
+		return s.replay(conn, consumed.Bytes(), 2)
+	}
+	host, port, err := readAddr(r)
+	if err != nil {
+		conn.Write([]byte{Version, byte(ReplyAddressNotSupported), 0, IPV4, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return err
+	}
+	defer conn.Close()
+	return associate(conn, host, port)
+}
+
+// replay 把连接连同已读取的字节交给 go-socks5
+func (s *SocksServer) replay(conn net.Conn, consumed []byte, skip int) error {
+	return s.socks.ServeConn(&replayConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(bytes.Clone(consumed)), conn),
+		skip: skip,
+	})
+}
+
+// replayConn 先读出已消耗的字节再读连接, 并丢弃开头 skip 字节的写入
+type replayConn struct {
+	net.Conn
+	r    io.Reader
+	skip int
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	n := min(c.skip, len(p))
+	c.skip -= n
+	if n == len(p) {
+		return n, nil
+	}
+	m, err := c.Conn.Write(p[n:])
+	return n + m, err
+}
+
+// udpAssociate 客户端一侧的 UDP 关联
+type udpAssociate struct {
+	relay *net.UDPConn // 面向 SOCKS 客户端, 绑定在控制连接的本地地址上
+	out   *net.UDPConn // 面向目的地址
+
+	mu       sync.Mutex
+	declared netip.AddrPort // 请求中声明的客户端地址, 未声明的部分为零值
+	src      netip.AddrPort // 第一个符合声明的数据报确定的客户端地址
+	dests    map[string]netip.AddrPort
+	peers    map[netip.AddrPort]bool // 发送过的目的地址, 只接受它们的回包
+}
+
+// associate 打开中继并转发数据报, 控制连接关闭时返回
+func associate(conn net.Conn, host string, port uint16) error {
+	var ip netip.Addr
+	if a, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		ip = a.AddrPort().Addr().Unmap()
+	}
+	relay, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)))
+	if err != nil {
+		conn.Write([]byte{Version, byte(ReplyGeneralFailure), 0, IPV4, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	defer relay.Close()
+	out, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		conn.Write([]byte{Version, byte(ReplyGeneralFailure), 0, IPV4, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	defer out.Close()
+
+	a := &udpAssociate{
+		relay: relay,
+		out:   out,
+		dests: make(map[string]netip.AddrPort),
+		peers: make(map[netip.AddrPort]bool),
+	}
+	if d, err := netip.ParseAddr(host); err == nil && !d.IsUnspecified() {
+		a.declared = netip.AddrPortFrom(d.Unmap(), port)
+	} else {
+		a.declared = netip.AddrPortFrom(netip.Addr{}, port)
+	}
+
+	// 中继绑定在全零地址时 BND.ADDR 也为全零, 客户端改用代理的地址
+	bnd := relay.LocalAddr().(*net.UDPAddr).AddrPort()
+	reply, err := appendAddr([]byte{Version, byte(ReplySucceeded), 0}, bnd.Addr().Unmap().String(), bnd.Port())
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(reply); err != nil {
+		return err
+	}
+
+	go func() {
+		// 控制连接上不再有数据往来, 读到 EOF 即关联结束
+		io.Copy(io.Discard, conn)
+		relay.Close()
+		out.Close()
+	}()
+	go a.serveReplies()
+	a.serveRequests()
+	return nil
+}
+
+// serveRequests 转发客户端发来的数据报, 丢弃分片与来源不符的数据报
+func (a *udpAssociate) serveRequests() {
+	buf := make([]byte, maxUDPHeaderLen+MaxDatagramSize)
+	for {
+		n, from, err := a.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n < 4 || buf[2] != 0 || !a.checkSource(unmapAddrPort(from)) {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		host, port, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		dst, ok := a.resolve(host, port)
+		if !ok {
+			continue
+		}
+		a.out.WriteToUDPAddrPort(buf[n-r.Len():n], dst)
+	}
+}
+
+// serveReplies 把目的地址的回包加上头部发给客户端
+func (a *udpAssociate) serveReplies() {
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, from, err := a.out.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		from = unmapAddrPort(from)
+		a.mu.Lock()
+		src, ok := a.src, a.peers[from]
+		a.mu.Unlock()
+		if !ok || !src.IsValid() {
+			continue
+		}
+		b, _ := appendAddr(make([]byte, 3, maxUDPHeaderLen+n), from.Addr().String(), from.Port())
+		a.relay.WriteToUDPAddrPort(append(b, buf[:n]...), src)
+	}
+}
+
+// checkSource 只接受与请求中声明的地址相符的数据报, 第一个相符的数据报确定客户端地址
+func (a *udpAssociate) checkSource(from netip.AddrPort) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.src.IsValid() {
+		return from == a.src
+	}
+	if a.declared.Addr().IsValid() && from.Addr() != a.declared.Addr() {
+		return false
+	}
+	if a.declared.Port() != 0 && from.Port() != a.declared.Port() {
+		return false
+	}
+	a.src = from
+	return true
+}
+
+// resolve 返回目的地址, 域名的解析结果按关联缓存
+func (a *udpAssociate) resolve(host string, port uint16) (netip.AddrPort, bool) {
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	a.mu.Lock()
+	dst, ok := a.dests[key]
+	a.mu.Unlock()
+	if ok {
+		return dst, true
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		dst = netip.AddrPortFrom(ip.Unmap(), port)
+	} else {
+		addr, err := net.ResolveUDPAddr("udp", key)
+		if err != nil {
+			return netip.AddrPort{}, false
+		}
+		dst = unmapAddrPort(addr.AddrPort())
+	}
+
+	a.mu.Lock()
+	if len(a.dests) >= maxAssociateDests {
+		clear(a.dests)
+		clear(a.peers)
+	}
+	a.dests[key] = dst
+	a.peers[dst] = true
+	a.mu.Unlock()
+	return dst, true
+}
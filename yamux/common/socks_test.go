@@ -0,0 +1,391 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// startSocks 启动 go-socks5 服务端, creds 不为空时要求账号密码认证
+func startSocks(t *testing.T, creds socks5.StaticCredentials) string {
+	t.Helper()
+	conf := &socks5.Config{}
+	if creds != nil {
+		conf.AuthMethods = []socks5.Authenticator{socks5.UserPassAuthenticator{Credentials: creds}}
+	}
+	srv, err := socks5.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Serve(ln)
+	return ln.Addr().String()
+}
+
+func startEcho(t *testing.T, network, addr string) string {
+	t.Helper()
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skipf("listen %s: %v", addr, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func echoThrough(t *testing.T, d *SocksDialer, target string) {
+	t.Helper()
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("dial %s: %v", target, err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo via %s: %q, %v", target, buf, err)
+	}
+}
+
+func TestSocksDialer(t *testing.T) {
+	proxy := startSocks(t, nil)
+	echoThrough(t, NewSocksDialer("tcp", proxy, nil), startEcho(t, "tcp4", "127.0.0.1:0"))
+	// IPv6 目标与 IPv6 BND.ADDR 应答
+	echoThrough(t, NewSocksDialer("tcp", proxy, nil), startEcho(t, "tcp6", "[::1]:0"))
+
+	// 目标拒绝连接映射为 ECONNREFUSED
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := ln.Addr().String()
+	ln.Close()
+	_, err := NewSocksDialer("tcp", proxy, nil).Dial("tcp", closed)
+	var re *ReplyError
+	if !errors.As(err, &re) || re.Code != ReplyConnectionRefused || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("dial closed port: err = %v", err)
+	}
+}
+
+func TestSocksDialerAuth(t *testing.T) {
+	proxy := startSocks(t, socks5.StaticCredentials{"alice": "s3cret"})
+	target := startEcho(t, "tcp4", "127.0.0.1:0")
+
+	echoThrough(t, NewSocksDialer("tcp", proxy, &SocksCredentials{"alice", "s3cret"}), target)
+
+	_, err := NewSocksDialer("tcp", proxy, &SocksCredentials{"alice", "wrong"}).Dial("tcp", target)
+	if !errors.Is(err, ErrSocksAuthFailed) {
+		t.Errorf("wrong password: err = %v", err)
+	}
+	_, err = NewSocksDialer("tcp", proxy, nil).Dial("tcp", target)
+	if !errors.Is(err, ErrNoAcceptableMethod) {
+		t.Errorf("no credentials: err = %v", err)
+	}
+}
+
+func TestSocksDialerContext(t *testing.T) {
+	// 只接受连接不应答的代理
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = NewSocksDialer("tcp", ln.Addr().String(), nil).DialContext(ctx, "tcp", "example.com:80")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled dial: err = %v", err)
+	}
+}
+
+func TestSocksRequest(t *testing.T) {
+	for _, tc := range []struct {
+		host string
+		req  []byte
+	}{
+		{"10.0.0.2", []byte{1, 10, 0, 0, 2}},
+		{"::ffff:10.0.0.2", []byte{1, 10, 0, 0, 2}},
+		{"fd00::1", []byte{4, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{"dns.internal", append([]byte{3, 12}, "dns.internal"...)},
+	} {
+		// 应答中的 BND.ADDR 为域名, 长度可变
+		reply := append([]byte{Version, 0, 0, Com, 5}, "relay"...)
+		reply = append(reply, 0x04, 0x38)
+		var out bytes.Buffer
+		conn := struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(reply), &out}
+
+		bnd, err := Request(conn, Connect, tc.host, 53)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.host, err)
+		}
+		if bnd.String() != "relay:1080" {
+			t.Errorf("%s: BND = %s", tc.host, bnd)
+		}
+		want := append(append([]byte{Version, Connect, 0}, tc.req...), 0, 53)
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("%s: request = %x, want %x", tc.host, out.Bytes(), want)
+		}
+	}
+
+	_, err := ReadReply(bytes.NewReader([]byte{Version, byte(ReplyNotAllowed), 0, IPV4, 0, 0, 0, 0, 0, 0}))
+	var re *ReplyError
+	if !errors.As(err, &re) || re.Code != ReplyNotAllowed {
+		t.Errorf("not allowed reply: err = %v", err)
+	}
+}
+
+// startAssociate 只支持 UDP ASSOCIATE 的最小 SOCKS5 服务端, 应答全零 BND.ADDR,
+// 把请求中声明的端口发到 declared; 每个回包之前先发一个分片数据报, 客户端应丢弃它
+func startAssociate(t *testing.T, declared chan<- uint16) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			ctrl, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ctrl.Close()
+				greeting := make([]byte, 3)
+				if _, err := io.ReadFull(ctrl, greeting); err != nil {
+					return
+				}
+				ctrl.Write([]byte{Version, NoAuthenticationRequired})
+				hdr := make([]byte, 3)
+				if _, err := io.ReadFull(ctrl, hdr); err != nil || hdr[1] != UDP {
+					return
+				}
+				_, port, err := readAddr(ctrl)
+				if err != nil {
+					return
+				}
+				declared <- port
+				relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					return
+				}
+				defer relay.Close()
+				reply, _ := appendAddr([]byte{Version, 0, 0}, "0.0.0.0", uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+				ctrl.Write(reply)
+				go relayAssociate(relay)
+				io.Copy(io.Discard, ctrl)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func relayAssociate(relay *net.UDPConn) {
+	buf := make([]byte, 2048)
+	var client net.Addr
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			r := bytes.NewReader(buf[3:n])
+			host, port, err := readAddr(r)
+			if err != nil {
+				continue
+			}
+			dst, _ := net.ResolveUDPAddr("udp", SocksAddr{host, port}.String())
+			relay.WriteTo(buf[n-r.Len():n], dst)
+			continue
+		}
+		src := from.(*net.UDPAddr).AddrPort()
+		frag, _ := appendAddr([]byte{0, 0, 1}, src.Addr().String(), src.Port())
+		relay.WriteTo(append(frag, "fragment"...), client)
+		b, _ := appendAddr([]byte{0, 0, 0}, src.Addr().String(), src.Port())
+		relay.WriteTo(append(b, buf[:n]...), client)
+	}
+}
+
+func TestSocksPacketConn(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	declared := make(chan uint16, 1)
+	proxy := startAssociate(t, declared)
+	// 本地 socket 的地址族跟随代理, 与 network 参数无关
+	pc, err := NewSocksDialer("tcp", proxy, nil).ListenPacket(context.Background(), "udp6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if got := pc.RelayAddr().(*net.UDPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("relay address %s, want the proxy address", pc.RelayAddr())
+	}
+	if port, want := <-declared, pc.LocalAddr().(*net.UDPAddr).Port; int(port) != want {
+		t.Errorf("declared port %d, want local port %d", port, want)
+	}
+
+	if _, err := pc.WriteTo([]byte("ping"), echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || from.String() != echo.LocalAddr().String() {
+		t.Errorf("read %q from %s", buf[:n], from)
+	}
+
+	// go-socks5 本身不支持 UDP ASSOCIATE
+	_, err = NewSocksDialer("tcp", startSocks(t, nil), nil).ListenPacket(context.Background(), "udp")
+	var re *ReplyError
+	if !errors.As(err, &re) || re.Code != ReplyCommandNotSupported {
+		t.Errorf("associate via go-socks5: err = %v", err)
+	}
+}
+
+// startSocksServer 启动客户端内置的 SOCKS 服务
+func startSocksServer(t *testing.T) string {
+	t.Helper()
+	srv, err := NewSocksServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeConn(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSocksServer(t *testing.T) {
+	proxy := startSocksServer(t)
+	d := NewSocksDialer("tcp", proxy, nil)
+	// 其他命令交给 go-socks5
+	echoThrough(t, d, startEcho(t, "tcp4", "127.0.0.1:0"))
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	pc, err := d.ListenPacket(context.Background(), "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// 其他端口发来的数据报被丢弃
+	foreign, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer foreign.Close()
+	b, _ := appendAddr([]byte{0, 0, 0}, "127.0.0.1", uint16(echo.LocalAddr().(*net.UDPAddr).Port))
+	foreign.WriteTo(append(b, "foreign"...), pc.RelayAddr())
+
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := pc.WriteTo([]byte(msg), echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg || from.String() != echo.LocalAddr().String() {
+			t.Errorf("read %q from %s, want %q", buf[:n], from, msg)
+		}
+	}
+	foreign.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := foreign.Read(make([]byte, 1500)); err == nil {
+		t.Errorf("foreign source got a %d byte reply", n)
+	}
+
+	// 关闭后中继随控制连接释放
+	relay := pc.RelayAddr().(*net.UDPAddr)
+	pc.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, err := net.ListenUDP("udp", relay)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("relay %s still open: %v", relay, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,223 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// TLSOptions 隧道 TLS 配置
+type TLSOptions struct {
+	CertFile string // 本端证书, 客户端用于双向认证
+	KeyFile  string
+	CAFile   string // 客户端: 校验服务端证书的 CA; 服务端: 校验客户端证书的 CA
+
+	// 以下仅客户端使用
+	ServerName string   // 覆盖校验时使用的服务端名称
+	Pins       []string // 服务端公钥 SPKI 的 SHA-256, base64 或 hex, 可带 "sha256/" 前缀
+	Insecure   bool     // 不校验服务端证书, 仅用于测试
+
+	// 以下仅服务端使用
+	RequireClientCert bool // 客户端必须出示由 CAFile 签发的证书
+}
+
+// ClientTLSConfig 构造客户端 TLS 配置; 设置了 Pins 而未设置 CAFile 时
+// 只校验公钥指纹, 适用于自签名证书
+func ClientTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: opts.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	pins, err := parsePins(opts.Pins)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case opts.Insecure:
+		config.InsecureSkipVerify = true
+	case len(pins) > 0 && opts.CAFile == "":
+		// 跳过证书链校验, 由 VerifyConnection 校验指纹
+		config.InsecureSkipVerify = true
+	}
+
+	if len(pins) > 0 {
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+	return config, nil
+}
+
+// ServerTLSConfig 构造服务端 TLS 配置, 设置 CAFile 后启用客户端证书校验
+func ServerTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if opts.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if opts.RequireClientCert {
+		return nil, errors.New("client certificate required but no client CA configured")
+	}
+	return config, nil
+}
+
+// PeerCertIdentity 返回已校验的对端证书的 CN, 没有证书时返回空串;
+// 调用前 TLS 握手必须已经完成
+func PeerCertIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	cs := tlsConn.ConnectionState()
+	if len(cs.VerifiedChains) == 0 || len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	return cs.PeerCertificates[0].Subject.CommonName
+}
+
+// CertIdentity 返回证书的 CN, 用于客户端缺省身份
+func CertIdentity(certFile string) (string, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return "", fmt.Errorf("no certificate found in %s", certFile)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", err
+		}
+		return cert.Subject.CommonName, nil
+	}
+}
+
+// CertSecrets 在客户端出示了可信证书时以证书 CN 作为身份:
+// 握手中声明的身份必须与 CN 一致; 密钥文件中有该身份时仍需校验密钥,
+// 否则客户端使用空密钥
+type CertSecrets struct {
+	Identity string
+	Next     SecretLookup
+}
+
+func (c CertSecrets) Secret(identity string) ([]byte, error) {
+	if identity != c.Identity {
+		return nil, ErrUnknownIdentity
+	}
+	if c.Next == nil {
+		return nil, nil
+	}
+	secret, err := c.Next.Secret(identity)
+	if errors.Is(err, ErrUnknownIdentity) {
+		return nil, nil
+	}
+	return secret, err
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+func parsePins(pins []string) ([][]byte, error) {
+	var out [][]byte
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		if pin == "" {
+			continue
+		}
+		var sum []byte
+		var err error
+		if len(pin) == hex.EncodedLen(sha256.Size) {
+			sum, err = hex.DecodeString(pin)
+		} else {
+			sum, err = base64.StdEncoding.DecodeString(pin)
+		}
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q", pin)
+		}
+		out = append(out, sum)
+	}
+	return out, nil
+}
+
+// SPKIPin 计算证书公钥指纹, 可用于生成 Pins 配置
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins 证书链已校验时允许指纹匹配链上任一证书,
+// 否则只有叶子证书证明了私钥持有, 只能匹配叶子证书
+func verifyPins(cs tls.ConnectionState, pins [][]byte) error {
+	var certs []*x509.Certificate
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(certs) == 0 && len(cs.PeerCertificates) > 0 {
+		certs = cs.PeerCertificates[:1]
+	}
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+				return nil
+			}
+		}
+	}
+	return errors.New("server certificate does not match any pinned key")
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+)
+
+const (
+	testCertFile = "../../cert/test.crt"
+	testKeyFile  = "../../cert/test.key"
+)
+
+func dialWithPins(t *testing.T, pins []string) error {
+	t.Helper()
+	serverConfig, err := ServerTLSConfig(TLSOptions{CertFile: testCertFile, KeyFile: testKeyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	clientConfig, err := ClientTLSConfig(TLSOptions{Pins: pins})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+func TestClientTLSPinning(t *testing.T) {
+	data, err := os.ReadFile(testCertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dialWithPins(t, []string{SPKIPin(cert)}); err != nil {
+		t.Errorf("dial with matching pin: %v", err)
+	}
+	if err := dialWithPins(t, []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}); err == nil {
+		t.Error("dial with wrong pin succeeded")
+	}
+	if _, err := ClientTLSConfig(TLSOptions{Pins: []string{"not-a-pin"}}); err == nil {
+		t.Error("invalid pin accepted")
+	}
+}
@@ -0,0 +1,203 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UDP 流: 服务端为每个 UDP 会话 (源地址, 目的地址) 打开一条 yamux 流,
+// 流的开头与 SOCKS5 请求区分开:
+//
+//	server -> client: | MAGIC 0xDA | VER (1) | ATYP (1) | DST.ADDR | DST.PORT (2) |
+//	双向:             | LEN (2) | DATAGRAM |
+//
+// 客户端从自己的 UDP socket 把数据报发往目的地址, 回包按同样的帧格式写回.
+// 任何一端关闭流即结束该 UDP 会话.
+const (
+	UDPStreamMagic   = 0xDA
+	udpStreamVersion = 1
+
+	// MaxDatagramSize UDP 载荷的最大长度
+	MaxDatagramSize = 65507
+
+	// DefaultUDPIdleTimeout UDP 会话无数据往来时的过期时间
+	DefaultUDPIdleTimeout = 60 * time.Second
+)
+
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// WriteUDPHeader 写入 UDP 流的开头
+func WriteUDPHeader(w io.Writer, host string, port uint16) error {
+	b, err := appendAddr([]byte{UDPStreamMagic, udpStreamVersion}, host, port)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadUDPHeader 读取 UDP 流的开头, 返回目的地址
+func ReadUDPHeader(r io.Reader) (string, uint16, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", 0, err
+	}
+	if hdr[0] != UDPStreamMagic {
+		return "", 0, fmt.Errorf("not a UDP stream: %#x", hdr[0])
+	}
+	if hdr[1] != udpStreamVersion {
+		return "", 0, fmt.Errorf("unsupported UDP stream version %d", hdr[1])
+	}
+	return readAddr(r)
+}
+
+// DatagramConn 在流上收发带长度前缀的数据报
+type DatagramConn struct {
+	r       io.Reader
+	w       io.Writer
+	maxSize int
+
+	mu sync.Mutex // 保证一个数据报的帧整体写入
+}
+
+// NewDatagramConn maxSize 为 0 时使用 MaxDatagramSize
+func NewDatagramConn(r io.Reader, w io.Writer, maxSize int) *DatagramConn {
+	if maxSize <= 0 || maxSize > MaxDatagramSize {
+		maxSize = MaxDatagramSize
+	}
+	return &DatagramConn{r: r, w: w, maxSize: maxSize}
+}
+
+// WriteDatagram 超过 maxSize 的数据报返回 ErrDatagramTooLarge, 不写入
+func (c *DatagramConn) WriteDatagram(p []byte) error {
+	if len(p) > c.maxSize {
+		return ErrDatagramTooLarge
+	}
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.w.Write(frame)
+	return err
+}
+
+// Write 以 p 作为一个数据报写入, 便于套用 io.Writer 包装 (计数、限速)
+func (c *DatagramConn) Write(p []byte) (int, error) {
+	if err := c.WriteDatagram(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadDatagram 读取一个数据报到 buf, buf 至少为 maxSize; 对端发来的超长数据报
+// 被丢弃并返回 ErrDatagramTooLarge, 之后可以继续读取
+func (c *DatagramConn) ReadDatagram(buf []byte) (int, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(c.r, l[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if n > c.maxSize || n > len(buf) {
+		if _, err := io.CopyN(io.Discard, c.r, int64(n)); err != nil {
+			return 0, err
+		}
+		return 0, ErrDatagramTooLarge
+	}
+	if _, err := io.ReadFull(c.r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// PeekConn 预读了开头字节的连接, 读取时先返回缓冲中的数据
+type PeekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func NewPeekConn(conn net.Conn) *PeekConn {
+	return &PeekConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Peek 返回第一个字节而不消耗它
+func (c *PeekConn) Peek() (byte, error) {
+	b, err := c.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (c *PeekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// ServeUDPStream 客户端处理 UDP 流: 向目的地址发送数据报并把回包写回流中,
+// 流关闭或超过 idle 没有数据往来时返回
+func ServeUDPStream(stream net.Conn, maxSize int, idle time.Duration) error {
+	host, port, err := ReadUDPHeader(stream)
+	if err != nil {
+		return err
+	}
+	if idle <= 0 {
+		idle = DefaultUDPIdleTimeout
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	dc := NewDatagramConn(stream, stream, maxSize)
+	timer := time.AfterFunc(idle, func() {
+		stream.Close()
+		conn.Close()
+	})
+	defer timer.Stop()
+
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					stream.Close()
+					return
+				}
+				continue // ICMP 端口不可达等错误不结束会话
+			}
+			timer.Reset(idle)
+			if err := dc.WriteDatagram(buf[:n]); err != nil && !errors.Is(err, ErrDatagramTooLarge) {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, err := dc.ReadDatagram(buf)
+		if errors.Is(err, ErrDatagramTooLarge) {
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		timer.Reset(idle)
+		if _, err := conn.Write(buf[:n]); errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+	}
+}
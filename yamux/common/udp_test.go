@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPHeader(t *testing.T) {
+	for _, host := range []string{"10.0.0.2", "fd00::1", "dns.internal"} {
+		var buf bytes.Buffer
+		if err := WriteUDPHeader(&buf, host, 53); err != nil {
+			t.Fatal(err)
+		}
+		gotHost, gotPort, err := ReadUDPHeader(&buf)
+		if err != nil {
+			t.Fatalf("ReadUDPHeader(%s): %v", host, err)
+		}
+		if gotHost != host || gotPort != 53 {
+			t.Errorf("header = %s:%d, want %s:53", gotHost, gotPort, host)
+		}
+	}
+
+	if _, _, err := ReadUDPHeader(bytes.NewReader([]byte{0x05, 0x01, 0x00})); err == nil {
+		t.Error("SOCKS5 greeting accepted as UDP header")
+	}
+}
+
+func TestDatagramConn(t *testing.T) {
+	var buf bytes.Buffer
+	dc := NewDatagramConn(&buf, &buf, 8)
+	for _, p := range [][]byte{[]byte("hello"), {}, []byte("12345678")} {
+		if err := dc.WriteDatagram(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dc.WriteDatagram(make([]byte, 9)); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Errorf("oversized datagram: err = %v", err)
+	}
+
+	p := make([]byte, MaxDatagramSize)
+	for _, want := range []string{"hello", "", "12345678"} {
+		n, err := dc.ReadDatagram(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p[:n]) != want {
+			t.Errorf("read %q, want %q", p[:n], want)
+		}
+	}
+
+	// 对端发来超过限制的帧
+	big := NewDatagramConn(&buf, &buf, 0)
+	big.WriteDatagram(make([]byte, 9))
+	big.WriteDatagram([]byte("after"))
+	if _, err := dc.ReadDatagram(p); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Errorf("oversized frame: err = %v", err)
+	}
+	// 超长帧被跳过, 后续数据报不受影响
+	if n, err := dc.ReadDatagram(p); err != nil || string(p[:n]) != "after" {
+		t.Errorf("datagram after oversized frame: %q, %v", p[:n], err)
+	}
+}
+
+func TestServeUDPStream(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(bytes.ToUpper(buf[:n]), addr)
+		}
+	}()
+
+	server, client := net.Pipe()
+	defer server.Close()
+	done := make(chan error, 1)
+	go func() { done <- ServeUDPStream(client, 0, 200*time.Millisecond) }()
+
+	if err := WriteUDPHeader(server, "127.0.0.1", uint16(echo.LocalAddr().(*net.UDPAddr).Port)); err != nil {
+		t.Fatal(err)
+	}
+	dc := NewDatagramConn(server, server, 0)
+	buf := make([]byte, MaxDatagramSize)
+	for _, msg := range []string{"ping", "pong"} {
+		if err := dc.WriteDatagram([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := dc.ReadDatagram(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != string(bytes.ToUpper([]byte(msg))) {
+			t.Errorf("reply %q", got)
+		}
+	}
+
+	// 空闲超时后关闭流
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("UDP stream not closed after idle timeout")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ares0516/tsuit/common"
+	"github.com/armon/go-socks5"
+	"github.com/hashicorp/yamux"
+	"github.com/sirupsen/logrus"
+)
+
+// clientRules 按客户端身份检查其经由隧道访问服务端网络的请求
+type clientRules struct {
+	s        *Server
+	identity string
+}
+
+func (r clientRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		return ctx, false
+	}
+	ip, _ := netip.AddrFromSlice(req.DestAddr.IP)
+	allowed := r.s.Access.Allow(r.identity, req.DestAddr.FQDN, ip.Unmap(), uint16(req.DestAddr.Port))
+	entry := logrus.WithFields(logrus.Fields{"identity": r.identity, "dest": req.DestAddr.String()})
+	if !allowed {
+		entry.Warn("Client access denied")
+		metricStreamsFailed.With("access_denied").Inc()
+		return ctx, false
+	}
+	entry.Info("Client access")
+	return ctx, true
+}
+
+// serveClientStreams 处理客户端主动打开的流 (本地端口转发),
+// 以 SOCKS5 协议读取目标并按 Access 规则放行
+func (s *Server) serveClientStreams(session *yamux.Session, identity, vip string) {
+	server, err := socks5.New(&socks5.Config{
+		Rules:  clientRules{s: s, identity: identity},
+		Dial:   s.clientDial(identity, vip),
+		Logger: log.New(logrus.StandardLogger().WriterLevel(logrus.DebugLevel), "", 0),
+	})
+	if err != nil {
+		logrus.Errorf("Create SOCKS server for %s failed: %v", identity, err)
+		return
+	}
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			done := _manager.TrackStream(session, stream, "inbound", identity, "")
+			defer done()
+			server.ServeConn(stream)
+		}()
+	}
+}
+
+// clientDial 连接客户端请求的目标; 与 relay 一样受 Limiter 限制,
+// 流量计入 Accounting 与 metricBytes
+func (s *Server) clientDial(identity, vip string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		limiter, err := s.Limiter.Open(identity)
+		if err != nil {
+			logrus.Warningf("Reject client %s access to %s: %v", identity, addr, err)
+			metricStreamsFailed.With("limit").Inc()
+			return nil, err
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			limiter.Close()
+			metricStreamsFailed.With("dial").Inc()
+			return nil, err
+		}
+		metricStreamsOpened.With(identity).Inc()
+
+		acct := s.Accounting.Open(identity, vip, addr)
+		return &meteredConn{
+			Conn:     conn,
+			identity: identity,
+			limiter:  limiter,
+			acct:     acct,
+			in:       acct.CountIn(limiter.LimitIn(conn)),
+			// 从目标读到的数据发往客户端, 读出后按 out 方向计数限速
+			out: acct.CountOut(limiter.LimitOut(io.Discard)),
+		}, nil
+	}
+}
+
+// meteredConn 客户端经由隧道访问的目标连接;
+// 写入目标的数据来自客户端 (in), 从目标读出的数据发往客户端 (out)
+type meteredConn struct {
+	net.Conn
+	identity  string
+	limiter   *common.StreamLimiter
+	acct      *common.StreamAccount
+	in, out   io.Writer
+	nin, nout atomic.Int64
+	closeOnce sync.Once
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.in.Write(p)
+	c.nin.Add(int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.out.Write(p[:n])
+		c.nout.Add(int64(n))
+	}
+	return n, err
+}
+
+// CloseWrite 让 go-socks5 在客户端关闭写方向后半关闭目标连接
+func (c *meteredConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *meteredConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.limiter.Close()
+		c.acct.Close()
+		metricBytes.With(c.identity, "in").Add(float64(c.nin.Load()))
+		metricBytes.With(c.identity, "out").Add(float64(c.nout.Load()))
+	})
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ares0516/tsuit/common"
+	"github.com/hashicorp/yamux"
+)
+
+func startEcho(t *testing.T) (string, uint16) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), uint16(addr.Port)
+}
+
+// openClientStream 以客户端身份经由隧道访问 host:port
+func openClientStream(t *testing.T, client *yamux.Session, host string, port uint16) (net.Conn, error) {
+	t.Helper()
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := common.Auth(stream); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if err := common.Requisition(stream, host, port, common.Connect); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+func TestClientStreamsLimitedAndAccounted(t *testing.T) {
+	access, err := common.NewTargetACL([]string{"*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Access:     access,
+		Limiter:    common.NewLimiter(common.Limits{MaxStreams: 1}, nil),
+		Accounting: common.NewAccounting(),
+	}
+	server, client := sessionPair(t)
+	go s.serveClientStreams(server, "alice", "10.9.1.1")
+
+	host, port := startEcho(t)
+	dest := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	conn, err := openClientStream(t, client, host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q, %v", buf, err)
+	}
+
+	// 并发流数已满
+	if c, err := openClientStream(t, client, host, port); err == nil {
+		c.Close()
+		t.Fatal("second stream allowed beyond MaxStreams")
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Accounting.Active()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream account not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	usage := s.Accounting.Usage("alice")
+	if len(usage) != 1 || usage[0].VIP != "10.9.1.1" || usage[0].Dest != dest ||
+		usage[0].BytesIn != 4 || usage[0].BytesOut != 4 {
+		t.Fatalf("usage = %+v", usage)
+	}
+
+	// 流结束后释放名额
+	conn, err = openClientStream(t, client, host, port)
+	if err != nil {
+		t.Fatalf("stream after close: %v", err)
+	}
+	conn.Close()
+}
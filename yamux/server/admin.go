@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/ares0516/tsuit/common"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionView 管理接口返回的会话信息
+type sessionView struct {
+	Identity    string    `json:"identity"`
+	VIP         string    `json:"vip"`
+	Aliases     []string  `json:"aliases,omitempty"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Uptime      string    `json:"uptime"`
+	RTT         string    `json:"rtt"`
+	Streams     int       `json:"streams"`
+	Caps        string    `json:"caps"`
+	Draining    bool      `json:"draining"`
+}
+
+// streamView 管理接口返回的流信息
+type streamView struct {
+	ID       uint32    `json:"id"`
+	Kind     string    `json:"kind"`
+	Source   string    `json:"source"`
+	Dest     string    `json:"dest"`
+	OpenedAt time.Time `json:"opened_at"`
+	Duration string    `json:"duration"`
+}
+
+func newSessionView(info common.SessionInfo) sessionView {
+	return sessionView{
+		Identity:    info.Identity,
+		VIP:         info.Addr,
+		Aliases:     info.Aliases,
+		RemoteAddr:  info.RemoteAddr,
+		ConnectedAt: info.ConnectedAt,
+		Uptime:      time.Since(info.ConnectedAt).Round(time.Second).String(),
+		RTT:         info.RTT.String(),
+		Streams:     info.NumStreams,
+		Caps:        info.Caps.String(),
+		Draining:    info.Draining,
+	}
+}
+
+// AdminHandler 管理接口:
+//
+//	GET  /api/sessions                 列出客户端会话
+//	GET  /api/sessions/{vip}           查看单个会话
+//	GET  /api/sessions/{vip}/streams   列出会话上的流
+//	POST /api/sessions/{vip}/kick      立即断开会话
+//	POST /api/sessions/{vip}/drain     不再分配新流, 现有流结束后断开
+//	POST /api/sessions/{vip}/reassign  更换虚拟地址, 请求体 {"vip": "10.0.0.9"}
+//	GET  /api/usage[?identity=]        按身份/虚拟地址/目的地址汇总的流量
+//	GET  /api/usage/active             进行中的流的实时流量
+//	GET  /api/limits                   默认限额与单独配置的客户端限额
+//	PUT  /api/limits/default           修改默认限额, 请求体为 common.Limits
+//	PUT  /api/limits/clients/{id}      单独配置客户端限额
+//	DELETE /api/limits/clients/{id}    恢复客户端的默认限额
+//	GET  /api/forwards                 列出远程端口转发
+//	POST /api/forwards                 添加转发, 请求体为 common.Forward
+//	DELETE /api/forwards/{listen}      删除转发
+func (s *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/sessions", s.adminListSessions)
+	mux.HandleFunc("GET /api/sessions/{vip}", s.adminGetSession)
+	mux.HandleFunc("GET /api/sessions/{vip}/streams", s.adminListStreams)
+	mux.HandleFunc("POST /api/sessions/{vip}/kick", s.adminKick)
+	mux.HandleFunc("POST /api/sessions/{vip}/drain", s.adminDrain)
+	mux.HandleFunc("POST /api/sessions/{vip}/reassign", s.adminReassign)
+	mux.HandleFunc("GET /api/usage", s.adminUsage)
+	mux.HandleFunc("GET /api/usage/active", s.adminActiveUsage)
+	mux.HandleFunc("GET /api/limits", s.adminLimits)
+	mux.HandleFunc("PUT /api/limits/default", s.adminSetDefaultLimits)
+	mux.HandleFunc("PUT /api/limits/clients/{id}", s.adminSetLimits)
+	mux.HandleFunc("DELETE /api/limits/clients/{id}", s.adminUnsetLimits)
+	mux.HandleFunc("GET /api/forwards", s.adminListForwards)
+	mux.HandleFunc("POST /api/forwards", s.adminAddForward)
+	mux.HandleFunc("DELETE /api/forwards/{listen}", s.adminRemoveForward)
+	if token == "" {
+		return mux
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveHTTP 在 addr 上提供 HTTP 服务, ctx 取消后关闭; 管理接口与指标共用
+func serveHTTP(ctx context.Context, name, addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("监听%s地址失败: %v", name, err)
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	logrus.Infof("%s listening on %s", name, ln.Addr())
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) adminListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := _manager.Sessions()
+	views := make([]sessionView, 0, len(sessions))
+	for _, info := range sessions {
+		views = append(views, newSessionView(info))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (s *Server) adminGetSession(w http.ResponseWriter, r *http.Request) {
+	info, ok := _manager.Info(r.PathValue("vip"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, newSessionView(info))
+}
+
+func (s *Server) adminListStreams(w http.ResponseWriter, r *http.Request) {
+	streams, ok := _manager.Streams(r.PathValue("vip"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	views := make([]streamView, 0, len(streams))
+	for _, st := range streams {
+		views = append(views, streamView{
+			ID:       st.ID,
+			Kind:     st.Kind,
+			Source:   st.Source,
+			Dest:     st.Dest,
+			OpenedAt: st.OpenedAt,
+			Duration: time.Since(st.OpenedAt).Round(time.Millisecond).String(),
+		})
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (s *Server) adminKick(w http.ResponseWriter, r *http.Request) {
+	vip := r.PathValue("vip")
+	if !_manager.IsExist(vip) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	logrus.Warnf("Admin kicked session %s", vip)
+	_manager.Remove(vip)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminDrain(w http.ResponseWriter, r *http.Request) {
+	vip := r.PathValue("vip")
+	if err := _manager.Drain(vip); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	logrus.Infof("Admin draining session %s", vip)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) adminReassign(w http.ResponseWriter, r *http.Request) {
+	vip := r.PathValue("vip")
+	var req struct {
+		VIP string `json:"vip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.VIP == "" {
+		writeError(w, http.StatusBadRequest, `body must be {"vip": "<address>"}`)
+		return
+	}
+	info, ok := _manager.Info(vip)
+	if !ok {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	newVIP, err := s.Reassign(info.Identity, vip, req.VIP)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	info, _ = _manager.Info(newVIP)
+	writeJSON(w, http.StatusOK, newSessionView(info))
+}
+
+func (s *Server) adminUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Accounting.Usage(r.URL.Query().Get("identity")))
+}
+
+func (s *Server) adminActiveUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Accounting.Active())
+}
+
+func (s *Server) adminLimits(w http.ResponseWriter, r *http.Request) {
+	defaults, clients := s.Limiter.Defaults()
+	writeJSON(w, http.StatusOK, map[string]any{"default": defaults, "clients": clients})
+}
+
+func (s *Server) adminSetDefaultLimits(w http.ResponseWriter, r *http.Request) {
+	lim, ok := decodeLimits(w, r)
+	if !ok {
+		return
+	}
+	s.Limiter.SetDefault(lim)
+	logrus.Infof("Admin set default limits: %+v", lim)
+	writeJSON(w, http.StatusOK, lim)
+}
+
+func (s *Server) adminSetLimits(w http.ResponseWriter, r *http.Request) {
+	lim, ok := decodeLimits(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	s.Limiter.Set(id, lim)
+	logrus.Infof("Admin set limits of %s: %+v", id, lim)
+	writeJSON(w, http.StatusOK, lim)
+}
+
+func (s *Server) adminUnsetLimits(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	s.Limiter.Unset(id)
+	logrus.Infof("Admin reset limits of %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminListForwards(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Forwards())
+}
+
+func (s *Server) adminAddForward(w http.ResponseWriter, r *http.Request) {
+	var f common.Forward
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := f.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.AddForward(f); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, f)
+}
+
+func (s *Server) adminRemoveForward(w http.ResponseWriter, r *http.Request) {
+	if err := s.RemoveForward(r.PathValue("listen")); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeLimits(w http.ResponseWriter, r *http.Request) (common.Limits, bool) {
+	var lim common.Limits
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&lim); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return lim, false
+	}
+	if err := lim.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return lim, false
+	}
+	return lim, true
+}
+
+// Reassign 把在线客户端迁移到新的虚拟地址, 租约、会话登记和静态路由一并更新
+// 返回规范化后的新地址
+func (s *Server) Reassign(identity, oldVIP, newVIP string) (string, error) {
+	addr, err := netip.ParseAddr(newVIP)
+	if err != nil {
+		return "", err
+	}
+	newVIP = addr.String()
+	if old, err := netip.ParseAddr(oldVIP); err == nil && old.Is4() != addr.Is4() {
+		return "", fmt.Errorf("%s and %s are of different address families", oldVIP, newVIP)
+	}
+	if _manager.IsExist(newVIP) {
+		return "", fmt.Errorf("address %s is in use", newVIP)
+	}
+	if err := s.Leases.Reassign(identity, newVIP); err != nil {
+		return "", err
+	}
+	if err := _manager.Rename(oldVIP, newVIP); err != nil {
+		s.Leases.Reassign(identity, oldVIP)
+		return "", err
+	}
+	s.Routes.Retarget(oldVIP, newVIP)
+	logrus.Infof("Reassigned %s from %s to %s", identity, oldVIP, newVIP)
+	return newVIP, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
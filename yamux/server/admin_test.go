@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ares0516/tsuit/common"
+)
+
+// adminServer 返回管理接口与已上线 alice (10.9.2.x) 和 bob 的服务端; carol 有租约但不在线
+func adminServer(t *testing.T, token string) (*Server, http.Handler, map[string]string) {
+	t.Helper()
+	leases, err := common.LoadLeaseStore(filepath.Join(t.TempDir(), "leases.json"), netip.MustParsePrefix("10.9.2.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Routes:     common.NewRouteTable(),
+		Leases:     leases,
+		Accounting: common.NewAccounting(),
+		Limiter:    common.NewLimiter(common.Limits{}, nil),
+	}
+	// 与 NewServer 相同, 随会话上下线维护主机路由
+	t.Cleanup(_manager.Subscribe(s.onSessionEvent))
+	vips := make(map[string]string)
+	for _, identity := range []string{"alice", "bob", "carol"} {
+		vip, err := leases.Acquire(identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vips[identity] = vip
+		if identity == "carol" {
+			continue
+		}
+		_manager.Add(vip, identity, 0, false, serverSession(t))
+		t.Cleanup(func() { _manager.Remove(vip) })
+	}
+	return s, s.AdminHandler(token), vips
+}
+
+func adminRequest(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// routeTargets 返回主机路由的目标
+func routeTargets(s *Server) map[string]string {
+	targets := make(map[string]string)
+	for _, r := range s.Routes.Routes() {
+		targets[r.Prefix.Addr().String()] = r.Target
+	}
+	return targets
+}
+
+func TestAdminToken(t *testing.T) {
+	_, h, _ := adminServer(t, "s3cret")
+	for _, auth := range []string{"", "Bearer wrong", "s3cret", "Bearer s3cret "} {
+		req := httptest.NewRequest("GET", "/api/sessions", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want 401", auth, w.Code)
+		}
+	}
+
+	w := adminRequest(t, h, "GET", "/api/sessions", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var sessions []sessionView
+	if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, v := range sessions {
+		found[v.Identity] = true
+	}
+	if !found["alice"] || !found["bob"] || found["carol"] {
+		t.Errorf("sessions %+v", sessions)
+	}
+}
+
+func TestAdminReassign(t *testing.T) {
+	s, h, vips := adminServer(t, "s3cret")
+	alice := vips["alice"]
+
+	// 失败的迁移不改变租约、会话登记与路由
+	for _, tc := range []struct {
+		name, body string
+		code       int
+	}{
+		{"online address", `{"vip": "` + vips["bob"] + `"}`, http.StatusConflict},
+		{"leased address", `{"vip": "` + vips["carol"] + `"}`, http.StatusConflict},
+		{"outside pool", `{"vip": "192.0.2.1"}`, http.StatusConflict},
+		{"network address", `{"vip": "10.9.2.0"}`, http.StatusConflict},
+		{"other family", `{"vip": "2001:db8::1"}`, http.StatusConflict},
+		{"bad body", `{"addr": "10.9.2.50"}`, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := adminRequest(t, h, "POST", "/api/sessions/"+alice+"/reassign", tc.body)
+			if w.Code != tc.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.code, w.Body)
+			}
+			if l, _ := s.Leases.Lookup("alice"); l.Addr != alice {
+				t.Errorf("lease moved to %s", l.Addr)
+			}
+			if info, ok := _manager.Info(alice); !ok || info.Identity != "alice" {
+				t.Errorf("session at %s: %+v, %v", alice, info, ok)
+			}
+			if target := routeTargets(s)[alice]; target != alice {
+				t.Errorf("route %s -> %q", alice, target)
+			}
+		})
+	}
+
+	if w := adminRequest(t, h, "POST", "/api/sessions/10.9.2.200/reassign", `{"vip": "10.9.2.50"}`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown session: status %d", w.Code)
+	}
+
+	w := adminRequest(t, h, "POST", "/api/sessions/"+alice+"/reassign", `{"vip": "10.9.2.50"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	t.Cleanup(func() { _manager.Remove("10.9.2.50") })
+	var v sessionView
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil || v.VIP != "10.9.2.50" || v.Identity != "alice" {
+		t.Fatalf("response %s, %v", w.Body, err)
+	}
+	if l, _ := s.Leases.Lookup("alice"); l.Addr != "10.9.2.50" {
+		t.Errorf("lease %s, want 10.9.2.50", l.Addr)
+	}
+	if _manager.IsExist(alice) || !_manager.IsExist("10.9.2.50") {
+		t.Error("session not renamed")
+	}
+	targets := routeTargets(s)
+	if targets["10.9.2.50"] != "10.9.2.50" {
+		t.Errorf("routes %v", targets)
+	}
+	if _, ok := targets[alice]; ok {
+		t.Errorf("route for old address %s kept: %v", alice, targets)
+	}
+}
+
+func TestAdminKickAndDrain(t *testing.T) {
+	_, h, vips := adminServer(t, "")
+
+	if w := adminRequest(t, h, "POST", "/api/sessions/"+vips["bob"]+"/drain", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("drain: status %d: %s", w.Code, w.Body)
+	}
+	if info, _ := _manager.Info(vips["bob"]); !info.Draining {
+		t.Error("bob is not draining")
+	}
+	if w := adminRequest(t, h, "POST", "/api/sessions/10.9.2.200/drain", ""); w.Code != http.StatusNotFound {
+		t.Errorf("drain unknown session: status %d", w.Code)
+	}
+
+	if w := adminRequest(t, h, "POST", "/api/sessions/"+vips["alice"]+"/kick", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("kick: status %d: %s", w.Code, w.Body)
+	}
+	if _manager.IsExist(vips["alice"]) {
+		t.Error("alice still connected after kick")
+	}
+	if w := adminRequest(t, h, "POST", "/api/sessions/"+vips["alice"]+"/kick", ""); w.Code != http.StatusNotFound {
+		t.Errorf("second kick: status %d", w.Code)
+	}
+	if w := adminRequest(t, h, "GET", "/api/sessions/"+vips["alice"], ""); w.Code != http.StatusNotFound {
+		t.Errorf("kicked session: status %d", w.Code)
+	}
+}
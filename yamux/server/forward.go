@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/ares0516/tsuit/common"
+	"github.com/sirupsen/logrus"
+)
+
+// forwarder 一条运行中的远程端口转发
+type forwarder struct {
+	common.Forward
+	ln io.Closer
+}
+
+// AddForward 监听 f.Listen, 把接受的连接 (UDP 为数据报) 经由客户端 f.Client 转发到 f.Target
+func (s *Server) AddForward(f common.Forward) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	host, portStr, _ := net.SplitHostPort(f.Target)
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.forwards[f.Listen]; ok {
+		return fmt.Errorf("forward %s already exists", f.Listen)
+	}
+	if s.forwards == nil {
+		s.forwards = make(map[string]*forwarder)
+	}
+
+	if f.IsUDP() {
+		pc, err := net.ListenPacket("udp", f.Listen)
+		if err != nil {
+			return err
+		}
+		s.forwards[f.Listen] = &forwarder{Forward: f, ln: pc}
+		target := relayTarget{Kind: "forward/udp", Dest: f.Target, Host: host, Port: uint16(port)}
+		go s.serveUDPForward(pc.(*net.UDPConn), f.Client, target)
+		logrus.Infof("Forward udp %s -> %s via %s", f.Listen, f.Target, f.Client)
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+	s.forwards[f.Listen] = &forwarder{Forward: f, ln: ln}
+
+	target := relayTarget{Kind: "forward", Dest: f.Target, Host: host, Port: uint16(port)}
+	go func() {
+		err := common.Serve(ln, func(conn net.Conn) { s.handleForward(conn, f.Client, target) })
+		if err != nil {
+			logrus.Errorf("Forward %s stopped: %v", f.Listen, err)
+		}
+	}()
+	logrus.Infof("Forward %s -> %s via %s", f.Listen, f.Target, f.Client)
+	return nil
+}
+
+// serveUDPForward 按源地址把数据报分到各自的 UDP 会话, 回包从同一个 socket 发回
+func (s *Server) serveUDPForward(pc *net.UDPConn, client string, target relayTarget) {
+	buf := make([]byte, common.MaxDatagramSize)
+	for {
+		n, src, err := pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.Errorf("Forward udp %s stopped: %v", pc.LocalAddr(), err)
+			}
+			return
+		}
+		info, ok := _manager.Lookup(client)
+		if !ok {
+			logrus.Debugf("Drop datagram from %s to %s: client %s is not connected", src, target.Dest, client)
+			metricDatagramsDropped.With("no_session").Inc()
+			continue
+		}
+		s.relayDatagram(src.String(), info, target, buf[:n], replyFunc(func(p []byte) error {
+			_, err := pc.WriteToUDPAddrPort(p, src)
+			return err
+		}))
+	}
+}
+
+// RemoveForward 关闭监听, 已建立的连接不受影响
+func (s *Server) RemoveForward(listen string) error {
+	s.Lock()
+	defer s.Unlock()
+	fw, ok := s.forwards[listen]
+	if !ok {
+		return fmt.Errorf("forward %s not found", listen)
+	}
+	delete(s.forwards, listen)
+	logrus.Infof("Forward %s removed", listen)
+	return fw.ln.Close()
+}
+
+// Forwards 返回全部远程端口转发, 按监听地址排序
+func (s *Server) Forwards() []common.Forward {
+	s.Lock()
+	defer s.Unlock()
+	forwards := make([]common.Forward, 0, len(s.forwards))
+	for _, fw := range s.forwards {
+		forwards = append(forwards, fw.Forward)
+	}
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].Listen < forwards[j].Listen })
+	return forwards
+}
+
+func (s *Server) closeForwards() {
+	s.Lock()
+	defer s.Unlock()
+	for listen, fw := range s.forwards {
+		fw.ln.Close()
+		delete(s.forwards, listen)
+	}
+}
+
+func (s *Server) handleForward(conn net.Conn, client string, target relayTarget) {
+	defer conn.Close()
+	info, ok := _manager.Lookup(client)
+	if !ok {
+		logrus.Warningf("Reject forward from %s to %s: client %s is not connected", conn.RemoteAddr(), target.Dest, client)
+		metricStreamsFailed.With("no_session").Inc()
+		reject(conn)
+		return
+	}
+	s.relay(conn, info, target)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ares0516/tsuit/common"
+)
+
+// forwardClient 登记以 SOCKS 服务处理流的客户端 identity, 返回服务端
+func forwardClient(t *testing.T, identity, vip string) *Server {
+	t.Helper()
+	server, client := sessionPair(t)
+	socks, err := common.NewSocksServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			stream, err := client.AcceptStream()
+			if err != nil {
+				return
+			}
+			go socks.ServeConn(stream)
+		}
+	}()
+	_manager.Add(vip, identity, 0, false, server)
+	t.Cleanup(func() { _manager.Remove(vip) })
+
+	s := &Server{
+		Limiter:    common.NewLimiter(common.Limits{}, nil),
+		Accounting: common.NewAccounting(),
+	}
+	t.Cleanup(s.closeForwards)
+	return s
+}
+
+// echoServer 原样返回收到的数据
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go common.Serve(ln, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+	return ln.Addr().String()
+}
+
+// forwardAddr 返回转发实际监听的地址
+func forwardAddr(t *testing.T, s *Server, listen string) string {
+	t.Helper()
+	s.Lock()
+	defer s.Unlock()
+	fw, ok := s.forwards[listen]
+	if !ok {
+		t.Fatalf("forward %s not found", listen)
+	}
+	return fw.ln.(net.Listener).Addr().String()
+}
+
+func TestForward(t *testing.T) {
+	s := forwardClient(t, "alice", "10.9.3.1")
+	f := common.Forward{Listen: "127.0.0.1:0", Client: "alice", Target: echoServer(t)}
+	if err := s.AddForward(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddForward(f); err == nil {
+		t.Error("duplicate listen address accepted")
+	}
+	if forwards := s.Forwards(); len(forwards) != 1 || forwards[0] != f {
+		t.Errorf("forwards %+v", forwards)
+	}
+	addr := forwardAddr(t, s, f.Listen)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("got %q", buf)
+	}
+
+	// 移除后不再接受新连接, 已建立的连接不受影响
+	if err := s.RemoveForward(f.Listen); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveForward(f.Listen); err == nil {
+		t.Error("second remove succeeded")
+	}
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Error("removed forward still accepts connections")
+	}
+	if _, err := conn.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "again" {
+		t.Errorf("existing connection: %q, %v", buf, err)
+	}
+}
+
+func TestForwardClientOffline(t *testing.T) {
+	s := forwardClient(t, "alice", "10.9.3.1")
+	f := common.Forward{Listen: "127.0.0.1:0", Client: "bob", Target: echoServer(t)}
+	if err := s.AddForward(f); err != nil {
+		t.Fatal(err)
+	}
+
+	// 复位可能早于 connect 返回
+	conn, err := net.Dial("tcp", forwardAddr(t, s, f.Listen))
+	if err == nil {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("%v, want connection reset", err)
+	}
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/ares0516/tsuit/common"
+	"github.com/ares0516/tsuit/tproxy"
 	"github.com/hashicorp/yamux"
 	"github.com/sirupsen/logrus"
 )
@@ -32,115 +41,326 @@ const (
 
 type Server struct {
 	sync.Mutex
-	LocalAddress string // 本地地址
-	EntryAddress string // 入口地址
+	LocalAddress string      // 本地地址
+	EntryAddress string      // 入口地址
+	Capture      tproxy.Mode // 本地地址的捕获方式
+	LocalUDP     string      // TPROXY 捕获 UDP 的地址, 为空时不启用
 	AddressMap   map[string]*yamux.Session
+	Routes       *common.RouteTable  // 目的地址 -> 客户端路由
+	Leases       *common.LeaseStore  // 客户端身份 -> 虚拟地址
+	Secrets      *common.SecretStore // 客户端身份 -> 认证密钥
+	Accounting   *common.Accounting  // 流量统计
+	Limiter      *common.Limiter     // 按客户端限速
+	Access       *common.TargetACL   // 客户端经由隧道可访问的目标
+	UDP          common.UDPConfig    // UDP 会话空闲时间与数据报长度限制
+	Caps         common.Capability   // 允许客户端启用的能力
+	TLSConfig    *tls.Config
+	CertIdentity bool // 以客户端证书 CN 作为身份
+	YamuxConfig  *yamux.Config
+
+	ShutdownTimeout time.Duration // 退出时等待转发结束的最长时间
+
+	forwards map[string]*forwarder // 监听地址 -> 远程端口转发
+	udp      udpFlows
 }
 
 var _manager = common.NewManager()
 
-func NewServer(localAddress, entryAddress string) *Server {
-	return &Server{
+func NewServer(localAddress, entryAddress string, leases *common.LeaseStore, secrets *common.SecretStore) *Server {
+	s := &Server{
 		LocalAddress: localAddress,
 		EntryAddress: entryAddress,
+		Capture:      tproxy.ModeRedirect,
+		Routes:       common.NewRouteTable(),
+		Leases:       leases,
+		Secrets:      secrets,
+		Accounting:   common.NewAccounting(),
+		Limiter:      common.NewLimiter(common.Limits{}, nil),
+		Access:       &common.TargetACL{},
+		Caps:         common.SupportedCaps,
+
+		ShutdownTimeout: 30 * time.Second,
 	}
+	_manager.Subscribe(s.onSessionEvent)
+	return s
 }
 
-func (s *Server) startEntryServer() {
-	cert, err := tls.LoadX509KeyPair(CertFile, KeyFile)
-	if err != nil {
-		logrus.Errorf("加载证书失败: %v", err)
-		return
+// onSessionEvent 随会话上下线维护虚拟地址的主机路由
+func (s *Server) onSessionEvent(ev common.Event) {
+	logrus.WithFields(logrus.Fields{
+		"event":    ev.Type,
+		"vip":      ev.Info.Addr,
+		"identity": ev.Info.Identity,
+	}).Info("Session event")
+
+	switch ev.Type {
+	case common.EventConnect:
+		s.Routes.AddHost(ev.Info.Addr)
+		for _, alias := range ev.Info.Aliases {
+			s.Routes.AddHostVia(alias, ev.Info.Addr)
+		}
+	case common.EventDisconnect:
+		for _, vip := range append([]string{ev.Info.Addr}, ev.Info.Aliases...) {
+			if addr, err := netip.ParseAddr(vip); err == nil {
+				s.Routes.Remove(netip.PrefixFrom(addr, addr.BitLen()))
+			}
+		}
 	}
+}
 
-	config := &tls.Config{Certificates: []tls.Certificate{cert}}
-
-	listener, err := tls.Listen("tcp", s.EntryAddress, config)
+// Run 启动入口与本地监听, ctx 取消后停止接受新连接并排空现有会话
+func (s *Server) Run(ctx context.Context) error {
+	entry, err := tls.Listen("tcp", s.EntryAddress, s.TLSConfig)
 	if err != nil {
-		logrus.Errorf("监听入口地址失败: %v", err)
-		return
+		return fmt.Errorf("监听入口地址失败: %v", err)
 	}
-	defer listener.Close()
-
-	for {
-		conn, err := listener.Accept()
+	local, err := tproxy.Listen(s.Capture, "tcp", s.LocalAddress)
+	if err != nil {
+		entry.Close()
+		return fmt.Errorf("监听本地地址失败: %v", err)
+	}
+	if s.LocalUDP != "" {
+		localUDP, err := tproxy.ListenUDP("udp", s.LocalUDP)
 		if err != nil {
-			logrus.Errorf("接受连接失败: %v", err)
-			continue
+			entry.Close()
+			local.Close()
+			return fmt.Errorf("监听本地 UDP 地址失败: %v", err)
 		}
-		go s.handleEntryConnection(conn)
+		defer localUDP.Close()
+		go s.serveLocalUDP(localUDP)
 	}
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- common.Serve(entry, func(conn net.Conn) { s.handleEntryConnection(conn) })
+	}()
+	go func() {
+		errCh <- common.Serve(local, s.handleLocalConnection)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case err = <-errCh:
+	}
+	entry.Close()
+	local.Close()
+	s.closeForwards()
+	s.closeUDPFlows()
+	s.drain()
+	return err
 }
 
-func (s *Server) startLocalServer() {
-	conn, err := net.Listen("tcp", s.LocalAddress)
-	if err != nil {
-		logrus.Errorf("监听本地地址失败: %v", err)
-		return
+// drain 通知客户端不再打开新流, 等待进行中的转发结束,
+// 超过 ShutdownTimeout 后强制关闭全部会话
+func (s *Server) drain() {
+	sessions := _manager.Sessions()
+	for _, info := range sessions {
+		info.Session.GoAway()
 	}
-	defer conn.Close()
+	logrus.Infof("Shutting down, draining %d sessions", len(sessions))
 
-	for {
-		client, err := conn.Accept()
-		if err != nil {
-			logrus.Errorf("接受本地连接失败: %v", err)
-			continue
+	deadline := time.Now().Add(s.ShutdownTimeout)
+	for activeStreams(sessions) > 0 {
+		if time.Now().After(deadline) {
+			logrus.Warnf("Drain timeout after %v, closing %d remaining streams", s.ShutdownTimeout, activeStreams(sessions))
+			break
 		}
-		go s.handleLocalConnection(client)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, info := range sessions {
+		_manager.Remove(info.Addr)
 	}
+}
 
+func activeStreams(sessions []common.SessionInfo) int {
+	n := 0
+	for _, info := range sessions {
+		n += info.Session.NumStreams()
+	}
+	return n
 }
 
 func (s *Server) handleLocalConnection(conn net.Conn) {
 	defer conn.Close()
 	logrus.WithFields(logrus.Fields{"local address": conn.LocalAddr()}).Info("New local connection.\n")
-	destAddr, port, err := GetOriginalDst(conn)
+	dst, err := tproxy.OriginalDst(s.Capture, conn)
 	if err != nil {
 		logrus.Errorf("Failed to get original destination: %v", err)
 		return
 	}
-	logrus.WithFields(logrus.Fields{"dest address": destAddr}).Info("New local connection.\n")
+	logrus.WithFields(logrus.Fields{"dest address": dst}).Info("New local connection.\n")
 
-	session := _manager.Get("10.0.0.1") // use fake
+	info, route, err := s.lookupSession(dst.Addr().String())
+	if err != nil {
+		logrus.Warningf("Reject connection from %s to %s: %v", conn.RemoteAddr(), dst, err)
+		if errors.Is(err, common.ErrNoRoute) {
+			metricStreamsFailed.With("no_route").Inc()
+		} else {
+			metricStreamsFailed.With("no_session").Inc()
+		}
+		reject(conn)
+		return
+	}
 
-	if session == nil {
-		logrus.Warningf("No session found for IP address %s, closing connection from %s", destAddr, conn.RemoteAddr())
-		conn.Close()
+	// 目的地址按路由改写为客户端侧的真实地址
+	realAddr := route.Rewrite(dst.Addr())
+	logrus.Debugf("Forward %s as %s via %s", dst, netip.AddrPortFrom(realAddr, dst.Port()), route.Target)
+	s.relay(conn, info, relayTarget{
+		Kind: "tcp",
+		Dest: dst.String(),
+		Host: realAddr.String(),
+		Port: dst.Port(),
+	})
+}
+
+// relayTarget 一次转发的目标
+type relayTarget struct {
+	Kind string // 会话流列表中显示的类型
+	Dest string // 服务端视角的目的地址, 用于统计
+	Host string // 客户端侧的真实地址
+	Port uint16
+}
+
+// relay 经由客户端会话打开一条流, 让客户端连接 target, 然后双向转发;
+// 流数量与带宽受 Limiter 限制, 流量计入 Accounting
+func (s *Server) relay(conn net.Conn, info common.SessionInfo, target relayTarget) {
+	limiter, err := s.Limiter.Open(info.Identity)
+	if err != nil {
+		logrus.Warningf("Reject connection from %s to %s: %s: %v", conn.RemoteAddr(), target.Dest, info.Identity, err)
+		metricStreamsFailed.With("limit").Inc()
+		reject(conn)
 		return
 	}
+	defer limiter.Close()
 
-	stream, err := session.Open()
+	start := time.Now()
+	stream, err := info.Session.OpenStream()
 	if err != nil {
 		logrus.Errorf("Could not open session : %s\n", err)
+		metricStreamsFailed.With("open").Inc()
 		return
 	}
+	defer stream.Close()
+	metricStreamsOpened.With(info.Identity).Inc()
+
+	done := _manager.TrackStream(info.Session, stream, target.Kind, conn.RemoteAddr().String(), target.Dest)
+	defer done()
 
 	//在stream上做socks5认证
-	common.Auth(stream)
+	if err := common.Auth(stream); err != nil {
+		logrus.Errorf("SOCKS auth via %s failed: %v", info.Addr, err)
+		metricStreamsFailed.With("socks").Inc()
+		return
+	}
 
 	//建立socks连接
-	common.Requisition(stream, "127.0.0.1", port, common.Connect)
+	if err := common.Requisition(stream, target.Host, target.Port, common.Connect); err != nil {
+		logrus.Warningf("Connect %s:%d via %s failed: %v", target.Host, target.Port, info.Addr, err)
+		metricStreamsFailed.With("dial").Inc()
+		reject(conn)
+		return
+	}
+	metricDialLatency.With().Observe(time.Since(start).Seconds())
 
+	acct := s.Accounting.Open(info.Identity, info.Addr, target.Dest)
+	defer acct.Close()
+
+	copied := make(chan struct{})
 	go func() {
-		io.Copy(conn, stream)
+		n, _ := io.Copy(acct.CountIn(limiter.LimitIn(conn)), stream)
+		metricBytes.With(info.Identity, "in").Add(float64(n))
 		conn.Close()
+		close(copied)
 	}()
-	io.Copy(stream, conn)
+	n, _ := io.Copy(acct.CountOut(limiter.LimitOut(stream)), conn)
+	metricBytes.With(info.Identity, "out").Add(float64(n))
+	stream.Close()
+	<-copied
+}
+
+// kickRevoked 密钥文件重新加载后, 断开已被吊销或删除的客户端;
+// 证书认证的客户端不要求出现在密钥文件中, 只在被吊销时断开
+func (s *Server) kickRevoked() {
+	for _, info := range _manager.Sessions() {
+		var secrets common.SecretLookup = s.Secrets
+		if info.CertAuth {
+			secrets = common.CertSecrets{Identity: info.Identity, Next: s.Secrets}
+		}
+		if _, err := secrets.Secret(info.Identity); err != nil {
+			logrus.Warnf("Identity %s revoked, closing session %s", info.Identity, info.Addr)
+			_manager.Remove(info.Addr)
+		}
+	}
+}
+
+// lookupSession 按路由表查找目的地址对应的客户端会话
+func (s *Server) lookupSession(destAddr string) (common.SessionInfo, common.Route, error) {
+	addr, err := netip.ParseAddr(destAddr)
+	if err != nil {
+		return common.SessionInfo{}, common.Route{}, err
+	}
+	route, err := s.Routes.Lookup(addr)
+	if err != nil {
+		return common.SessionInfo{}, common.Route{}, err
+	}
+	info, ok := _manager.Info(route.Target)
+	if !ok || info.Draining {
+		return common.SessionInfo{}, route, fmt.Errorf("no session for %s", route)
+	}
+	return info, route, nil
+}
+
+// reject 以 RST 关闭连接, 让发起方立即得到 connection refused
+func reject(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
 }
 
 // 处理客户端传入链接
-func (s *Server) handleEntryConnection(conn net.Conn) (*yamux.Session, error) {
+func (s *Server) handleEntryConnection(conn net.Conn) (session *yamux.Session, err error) {
 	logrus.WithFields(logrus.Fields{"remoteaddr": conn.RemoteAddr().String()}).Info("New relay connection.\n")
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	// 先完成 TLS 握手, 以便取得客户端证书
+	var secrets common.SecretLookup = s.Secrets
+	certAuth := false
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(common.HandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			logrus.Errorf("TLS handshake failed: %v", err)
+			metricHandshakeFailures.With("tls").Inc()
+			return nil, err
+		}
+		if id := common.PeerCertIdentity(conn); id != "" && s.CertIdentity {
+			secrets = common.CertSecrets{Identity: id, Next: s.Secrets}
+			certAuth = true
+		}
+	}
 
-	err := common.PipeCheck(conn)
+	var vip string
+	hs, err := common.ServerHandshake(conn, secrets, s.Caps, func(identity string) (err error) {
+		vip, err = s.Leases.Acquire(identity)
+		if err != nil {
+			logrus.Errorf("分配虚拟地址失败, identity: %s, err: %v", identity, err)
+		}
+		return err
+	})
 	if err != nil {
-		logrus.Errorf("PipeCheck failed: %v", err)
+		logrus.Errorf("Handshake failed: %v", err)
+		metricHandshakeFailures.With(handshakeFailureReason(err)).Inc()
 		return nil, err
-	} else {
-		logrus.Info("PipeCheck success.\n")
 	}
+	identity := hs.Identity
+	logrus.Infof("Handshake success, identity: %s, version: %d, caps: %s\n", identity, hs.Version, hs.Caps)
 
-	session, err := yamux.Server(conn, nil)
+	session, err = yamux.Server(common.WrapConn(conn, hs.Caps), s.YamuxConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -150,52 +370,198 @@ func (s *Server) handleEntryConnection(conn net.Conn) (*yamux.Session, error) {
 	}
 	logrus.Printf("Session ping : %v\n", ping)
 
-	vip := allocAddr()
-	_manager.Add(vip, session)
+	// 双栈时 IPv6 地址作为会话别名
+	var aliases []string
+	if lease, ok := s.Leases.Lookup(identity); ok && lease.Addr6 != "" {
+		aliases = append(aliases, lease.Addr6)
+	}
+
+	// 同一身份重连时旧会话由 manager 关闭
+	_manager.Add(vip, identity, hs.Caps, certAuth, session, aliases...)
+	if hs.Caps.Has(common.CapForward) {
+		go s.serveClientStreams(session, identity, vip)
+	}
 	_manager.Dump()
 
 	return session, nil
 }
 
-func allocAddr() string {
-	for i := 1; i < 255; i++ {
-		addr := fmt.Sprintf("10.0.0.%d", i)
-		if !_manager.IsExist(addr) {
-			return addr
-		}
+// routeFlags 支持重复指定 -route
+type routeFlags []string
+
+func (f *routeFlags) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *routeFlags) Set(value string) error {
+	if _, err := common.ParseRoute(value); err != nil {
+		return err
 	}
-	return ""
+	*f = append(*f, value)
+	return nil
 }
 
 func main() {
-	localAddress := flag.String("local", "0.0.0.0:5555", "The local address")
-	entryAddress := flag.String("entry", "0.0.0.0:1080", "The entry address")
+	var routes routeFlags
+	defaults := common.DefaultServerConfig()
+	configFile := flag.String("config", "", "The YAML configuration file")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and exit")
+	localAddress := flag.String("local", defaults.Listen.Local, "The local address")
+	entryAddress := flag.String("entry", defaults.Listen.Entry, "The entry address")
+	capture := flag.String("capture", "redirect", "How the local address captures traffic (redirect, tproxy)")
+	localUDP := flag.String("local-udp", "", "The TPROXY UDP capture address, disabled if empty")
+	leaseFile := flag.String("lease-file", defaults.LeaseFile, "The file to persist identity to VIP leases")
+	usageFile := flag.String("usage-file", defaults.Accounting.File, "The file traffic totals are flushed to, memory only if empty")
+	pool := flag.String("pool", defaults.Pool, "The virtual address pool")
+	pool6 := flag.String("pool6", "", "The IPv6 virtual address pool for dual-stack clients, e.g. fd00:7473::/64")
+	secretsFile := flag.String("secrets", defaults.Auth.SecretsFile, "The per-client secrets file, reloaded on change")
+	certFile := flag.String("cert", CertFile, "The server certificate file")
+	keyFile := flag.String("key", KeyFile, "The server private key file")
+	clientCA := flag.String("client-ca", "", "The CA file used to verify client certificates")
+	requireClientCert := flag.Bool("require-client-cert", false, "Reject clients without a valid certificate")
+	certIdentity := flag.Bool("cert-identity", false, "Use the client certificate common name as the client identity")
+	adminAddress := flag.String("admin", "", "The admin API address, disabled if empty")
+	metricsAddress := flag.String("metrics", "", "The Prometheus /metrics address, disabled if empty")
+	logLevel := flag.String("log-level", "", "The log level (debug, info, warn, error)")
+	flag.Var(&routes, "route", "Static route CIDR=VIP[@CIDR], may be repeated (e.g. 10.0.2.0/24=10.0.0.2@192.168.1.0/24)")
 	flag.Parse()
-	server := NewServer(*localAddress, *entryAddress)
-	go server.startEntryServer()
-	server.startLocalServer()
-}
 
-func GetOriginalDst(conn net.Conn) (string, uint16, error) {
-	tcpConn, ok := conn.(*net.TCPConn)
-	if !ok {
-		return "", 0, fmt.Errorf("not a TCP connection")
+	cfg := defaults
+	if *configFile != "" {
+		var err error
+		if cfg, err = common.LoadServerConfig(*configFile); err != nil {
+			exitConfigError(err)
+		}
+	}
+
+	// 命令行参数覆盖配置文件
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "local":
+			cfg.Listen.Local = *localAddress
+		case "entry":
+			cfg.Listen.Entry = *entryAddress
+		case "capture":
+			cfg.Listen.Capture = *capture
+		case "local-udp":
+			cfg.Listen.LocalUDP = *localUDP
+		case "lease-file":
+			cfg.LeaseFile = *leaseFile
+		case "usage-file":
+			cfg.Accounting.File = *usageFile
+		case "pool":
+			cfg.Pool = *pool
+		case "pool6":
+			cfg.Pool6 = *pool6
+		case "secrets":
+			cfg.Auth.SecretsFile = *secretsFile
+			cfg.Auth.Clients = nil
+		case "cert":
+			cfg.TLS.Cert = *certFile
+		case "key":
+			cfg.TLS.Key = *keyFile
+		case "client-ca":
+			cfg.TLS.ClientCA = *clientCA
+		case "require-client-cert":
+			cfg.TLS.RequireClientCert = *requireClientCert
+		case "cert-identity":
+			cfg.TLS.CertIdentity = *certIdentity
+		case "admin":
+			cfg.Admin.Listen = *adminAddress
+		case "metrics":
+			cfg.Metrics.Listen = *metricsAddress
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "route":
+			cfg.Routes = routes
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		exitConfigError(err)
+	}
+	if *checkConfig {
+		fmt.Println("configuration OK")
+		return
+	}
+	cfg.Log.Apply()
+
+	leases, err := common.LoadLeaseStore(cfg.LeaseFile, cfg.Pools()...)
+	if err != nil {
+		logrus.Fatalf("加载租约文件失败: %v", err)
+	}
+
+	secrets, err := cfg.Auth.SecretStore()
+	if err != nil {
+		logrus.Fatalf("加载密钥文件失败: %v", err)
 	}
 
-	file, err := tcpConn.File()
+	tlsConfig, err := common.ServerTLSConfig(cfg.TLS.Options())
 	if err != nil {
-		return "", 0, err
+		logrus.Fatalf("加载证书失败: %v", err)
 	}
-	defer file.Close()
 
-	fd := int(file.Fd())
-	addr, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, 80)
+	accounting, err := common.LoadAccounting(cfg.Accounting.File)
 	if err != nil {
-		return "", 0, err
+		logrus.Fatalf("加载流量统计失败: %v", err)
 	}
 
-	ip := net.IPv4(addr.Multiaddr[4], addr.Multiaddr[5], addr.Multiaddr[6], addr.Multiaddr[7])
-	port := uint16(addr.Multiaddr[2])<<8 + uint16(addr.Multiaddr[3])
+	server := NewServer(cfg.Listen.Local, cfg.Listen.Entry, leases, secrets)
+	server.Capture, _ = tproxy.ParseMode(cfg.Listen.Capture)
+	server.LocalUDP = cfg.Listen.LocalUDP
+	server.TLSConfig = tlsConfig
+	server.CertIdentity = cfg.TLS.CertIdentity
+	server.YamuxConfig = cfg.Yamux.Config()
+	server.ShutdownTimeout = cfg.ShutdownTimeout
+	server.Accounting = accounting
+	server.UDP = cfg.UDP
+	server.Limiter = common.NewLimiter(cfg.Limits.Default, cfg.Limits.Clients)
+	if server.Access, err = common.NewTargetACL(cfg.Access.Default, cfg.Access.Clients); err != nil {
+		logrus.Fatalf("访问规则错误: %v", err)
+	}
+	for _, r := range cfg.ParsedRoutes() {
+		server.Routes.Add(r)
+	}
+	for _, f := range cfg.Forwards {
+		if err := server.AddForward(f); err != nil {
+			logrus.Fatalf("启动端口转发 %s 失败: %v", f.Listen, err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.Auth.SecretsFile != "" {
+		go secrets.Watch(ctx, 5*time.Second, server.kickRevoked)
+	}
+	if cfg.Admin.Listen != "" {
+		go func() {
+			if err := serveHTTP(ctx, "管理接口", cfg.Admin.Listen, server.AdminHandler(cfg.Admin.Token)); err != nil {
+				logrus.Errorf("Admin API stopped: %v", err)
+			}
+		}()
+	}
+	if cfg.Metrics.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", _metrics)
+		go func() {
+			if err := serveHTTP(ctx, "指标", cfg.Metrics.Listen, mux); err != nil {
+				logrus.Errorf("Metrics endpoint stopped: %v", err)
+			}
+		}()
+	}
+	go accounting.Run(ctx, cfg.Accounting.FlushInterval)
+	if err := server.Run(ctx); err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	// 排空结束后再写一次, 计入最后结束的流
+	if err := accounting.Flush(); err != nil {
+		logrus.Errorf("写入流量统计失败: %v", err)
+	}
+	logrus.Info("Server stopped")
+}
 
-	return ip.String(), port, nil
+// exitConfigError 逐行输出配置错误后退出
+func exitConfigError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ares0516/tsuit/common"
+	"github.com/hashicorp/yamux"
+)
+
+// sessionPair 通过内存管道建立一对 yamux 会话
+func sessionPair(t *testing.T) (server, client *yamux.Session) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	server, err := yamux.Server(c1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = yamux.Client(c2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+func serverSession(t *testing.T) *yamux.Session {
+	server, _ := sessionPair(t)
+	return server
+}
+
+func writeSecrets(t *testing.T, path, data string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKickRevokedKeepsCertSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	now := time.Now()
+	writeSecrets(t, path, `clients:
+  - identity: bob
+    secret: "b0b"
+  - identity: erin
+    secret: "er1n"
+`, now.Add(-time.Minute))
+	store, err := common.LoadSecretStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Secrets: store}
+
+	// carol 只有证书, 不在密钥文件中; erin 以证书认证但文件中也有记录
+	_manager.Add("10.9.0.1", "carol", 0, true, serverSession(t))
+	_manager.Add("10.9.0.2", "bob", 0, false, serverSession(t))
+	_manager.Add("10.9.0.3", "erin", 0, true, serverSession(t))
+	_manager.Add("10.9.0.4", "dave", 0, false, serverSession(t))
+	t.Cleanup(func() {
+		for _, addr := range []string{"10.9.0.1", "10.9.0.2", "10.9.0.3", "10.9.0.4"} {
+			_manager.Remove(addr)
+		}
+	})
+
+	// 删除 bob, 吊销 erin; dave 本就不在文件中
+	writeSecrets(t, path, `clients:
+  - identity: erin
+    secret: "er1n"
+    revoked: true
+`, now)
+	if changed, err := store.Reload(); err != nil || !changed {
+		t.Fatalf("reload: changed %v, err %v", changed, err)
+	}
+	s.kickRevoked()
+
+	for addr, want := range map[string]bool{
+		"10.9.0.1": true,
+		"10.9.0.2": false,
+		"10.9.0.3": false,
+		"10.9.0.4": false,
+	} {
+		if got := _manager.IsExist(addr); got != want {
+			t.Errorf("session %s exists = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	server, client := sessionPair(t)
+	_manager.Add("10.9.4.1", "alice", 0, false, server)
+	t.Cleanup(func() { _manager.Remove("10.9.4.1") })
+
+	// 保持一条进行中的流
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		stream, err := client.AcceptStream()
+		if err == nil {
+			accepted <- stream
+		}
+	}()
+	stream, err := server.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("stream not accepted")
+	}
+
+	s := &Server{ShutdownTimeout: 500 * time.Millisecond}
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		s.drain()
+		close(done)
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := client.OpenStream(); err == nil {
+		t.Error("client opened a stream after GoAway")
+	}
+	select {
+	case <-done:
+		t.Fatalf("drain returned after %v with a stream open", time.Since(start))
+	default:
+	}
+	if server.IsClosed() || !_manager.IsExist("10.9.4.1") {
+		t.Fatal("session closed before the deadline")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain did not return after the deadline")
+	}
+	if elapsed := time.Since(start); elapsed < s.ShutdownTimeout {
+		t.Errorf("drain returned after %v, want at least %v", elapsed, s.ShutdownTimeout)
+	}
+	if !server.IsClosed() || _manager.IsExist("10.9.4.1") {
+		t.Error("session not closed after the deadline")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+
+	"github.com/ares0516/tsuit/common"
+)
+
+var (
+	_metrics = common.NewRegistry()
+
+	metricHandshakeFailures = _metrics.NewCounter("tsuit_handshake_failures_total",
+		"Tunnel handshakes rejected or aborted, by reason.", "reason")
+	metricStreamsOpened = _metrics.NewCounter("tsuit_streams_opened_total",
+		"Streams opened to clients.", "identity")
+	metricStreamsFailed = _metrics.NewCounter("tsuit_streams_failed_total",
+		"Local connections that could not be forwarded, by reason.", "reason")
+	metricBytes = _metrics.NewCounter("tsuit_client_bytes_total",
+		"Bytes relayed per client; in is received from the client, out is sent to it.", "identity", "direction")
+	metricDatagramsDropped = _metrics.NewCounter("tsuit_udp_datagrams_dropped_total",
+		"UDP datagrams dropped instead of relayed, by reason.", "reason")
+	metricDialLatency = _metrics.NewHistogram("tsuit_dial_duration_seconds",
+		"Time from opening a stream until the client connected to the destination.", common.DefLatencyBuckets)
+)
+
+func init() {
+	_metrics.NewGaugeFunc("tsuit_sessions_connected", "Client sessions currently connected.", func() float64 {
+		return float64(len(_manager.Sessions()))
+	})
+	_metrics.NewGaugeFunc("tsuit_streams_active", "Streams currently open across all sessions.", func() float64 {
+		n := 0
+		for _, info := range _manager.Sessions() {
+			n += info.NumStreams
+		}
+		return float64(n)
+	})
+}
+
+// handshakeFailureReason 把握手错误归类为指标标签
+func handshakeFailureReason(err error) string {
+	if errors.Is(err, common.ErrRevoked) {
+		return "revoked"
+	}
+	var reject *common.RejectError
+	if errors.As(err, &reject) {
+		switch reject.Code {
+		case common.RejectVersion:
+			return "version"
+		case common.RejectAuth:
+			return "auth"
+		case common.RejectRevoked:
+			return "revoked"
+		case common.RejectPoolExhausted:
+			return "pool_exhausted"
+		default:
+			return "internal"
+		}
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "timeout"
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return "timeout"
+	}
+	return "io"
+}
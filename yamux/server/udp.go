@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/ares0516/tsuit/common"
+	"github.com/ares0516/tsuit/tproxy"
+	"github.com/hashicorp/yamux"
+	"github.com/sirupsen/logrus"
+)
+
+// udpFlowKey 同一客户端会话中同一源地址发往同一目的地址的数据报属于一个 UDP 会话
+type udpFlowKey struct {
+	Session *yamux.Session
+	Src     string
+	Dest    string
+}
+
+// maxPendingDatagrams 流打开之前每个 UDP 会话最多暂存的数据报数
+const maxPendingDatagrams = 16
+
+// udpFlow 一个 UDP 会话, 独占一条 yamux 流, 超过空闲时间后关闭;
+// 流在后台打开, 打开之前到达的数据报暂存在 pending 中
+type udpFlow struct {
+	s      *Server
+	key    udpFlowKey
+	info   common.SessionInfo
+	target relayTarget
+	reply  io.Writer
+	timer  *time.Timer
+
+	mu      sync.Mutex
+	ready   bool // 流已打开, 暂存的数据报已发出
+	closed  bool
+	pending [][]byte
+
+	stream  *yamux.Stream
+	dc      *common.DatagramConn
+	out     io.Writer // 计数后写入 dc
+	limiter *common.StreamLimiter
+	acct    *common.StreamAccount
+	untrack func()
+
+	closeOnce sync.Once
+}
+
+// udpFlows 服务端全部 UDP 会话
+type udpFlows struct {
+	sync.Mutex
+	flows map[udpFlowKey]*udpFlow
+}
+
+// replyFunc 把客户端侧的回包发还给 UDP 会话的发起方, 不需要关闭
+type replyFunc func(p []byte) error
+
+func (f replyFunc) Write(p []byte) (int, error) {
+	if err := f(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// transparentReply 以原始目的地址为源地址把回包发给 TPROXY 捕获的发起方,
+// 透明 socket 在第一个回包时创建
+type transparentReply struct {
+	src, dst netip.AddrPort
+
+	mu     sync.Mutex
+	conn   *net.UDPConn
+	closed bool
+}
+
+func (r *transparentReply) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, net.ErrClosed
+	}
+	if r.conn == nil {
+		conn, err := tproxy.DialUDP(r.dst, r.src)
+		if err != nil {
+			return 0, err
+		}
+		r.conn = conn
+	}
+	return r.conn.Write(p)
+}
+
+func (r *transparentReply) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.conn != nil {
+		return r.conn.Close()
+	}
+	return nil
+}
+
+// serveLocalUDP 转发 TPROXY 捕获的数据报, 按原始目的地址查找路由
+func (s *Server) serveLocalUDP(pc *tproxy.UDPConn) {
+	buf := make([]byte, common.MaxDatagramSize)
+	for {
+		n, src, dst, err := pc.ReadFromOrig(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.Warningf("Read local UDP: %v", err)
+			continue
+		}
+		info, route, err := s.lookupSession(dst.Addr().String())
+		if err != nil {
+			logrus.Debugf("Drop datagram from %s to %s: %v", src, dst, err)
+			if errors.Is(err, common.ErrNoRoute) {
+				metricDatagramsDropped.With("no_route").Inc()
+			} else {
+				metricDatagramsDropped.With("no_session").Inc()
+			}
+			continue
+		}
+		target := relayTarget{
+			Kind: "udp",
+			Dest: dst.String(),
+			Host: route.Rewrite(dst.Addr()).String(),
+			Port: dst.Port(),
+		}
+		s.relayDatagram(src.String(), info, target, buf[:n], &transparentReply{src: src, dst: dst})
+	}
+}
+
+// relayDatagram 经由客户端会话转发一个数据报, 必要时为 (src, target) 新建 UDP 会话;
+// 客户端侧的回包写入 reply, reply 实现 io.Closer 时随会话关闭.
+// 在读取数据报的循环中调用, 不等待流打开或限速
+func (s *Server) relayDatagram(src string, info common.SessionInfo, target relayTarget, p []byte, reply io.Writer) {
+	if !info.Caps.Has(common.CapUDP) {
+		logrus.Debugf("Drop datagram from %s to %s: %s does not support UDP", src, target.Dest, info.Identity)
+		metricDatagramsDropped.With("no_udp").Inc()
+		return
+	}
+	flow := s.udpFlow(src, info, target, reply)
+	flow.timer.Reset(s.udpIdleTimeout())
+	flow.send(p)
+}
+
+func (s *Server) udpIdleTimeout() time.Duration {
+	if s.UDP.IdleTimeout > 0 {
+		return s.UDP.IdleTimeout
+	}
+	return common.DefaultUDPIdleTimeout
+}
+
+// udpFlow 返回已有的 UDP 会话, 不存在时登记新会话并在后台打开流
+func (s *Server) udpFlow(src string, info common.SessionInfo, target relayTarget, reply io.Writer) *udpFlow {
+	key := udpFlowKey{Session: info.Session, Src: src, Dest: target.Dest}
+	s.udp.Lock()
+	defer s.udp.Unlock()
+	if flow, ok := s.udp.flows[key]; ok {
+		return flow
+	}
+	flow := &udpFlow{s: s, key: key, info: info, target: target, reply: reply}
+	flow.timer = time.AfterFunc(s.udpIdleTimeout(), flow.close)
+	if s.udp.flows == nil {
+		s.udp.flows = make(map[udpFlowKey]*udpFlow)
+	}
+	s.udp.flows[key] = flow
+	go flow.open()
+	return flow
+}
+
+// send 流未打开时暂存数据报, 否则立即写入
+func (f *udpFlow) send(p []byte) {
+	f.mu.Lock()
+	if !f.ready {
+		full := len(f.pending) >= maxPendingDatagrams
+		if !f.closed && !full {
+			f.pending = append(f.pending, bytes.Clone(p))
+		}
+		f.mu.Unlock()
+		if full {
+			metricDatagramsDropped.With("pending").Inc()
+		}
+		return
+	}
+	f.mu.Unlock()
+	f.write(p)
+}
+
+// write 令牌不足时丢弃数据报而不是等待
+func (f *udpFlow) write(p []byte) {
+	if !f.limiter.AllowOut(len(p)) {
+		metricDatagramsDropped.With("rate_limit").Inc()
+		return
+	}
+	if _, err := f.out.Write(p); err != nil {
+		if errors.Is(err, common.ErrDatagramTooLarge) {
+			logrus.Debugf("Drop %d bytes datagram from %s to %s: %v", len(p), f.key.Src, f.target.Dest, err)
+			metricDatagramsDropped.With("too_large").Inc()
+			return
+		}
+		f.close()
+		return
+	}
+	metricBytes.With(f.info.Identity, "out").Add(float64(len(p)))
+}
+
+// open 打开流, 发出暂存的数据报, 然后把客户端侧的回包写入 reply 直到流关闭
+func (f *udpFlow) open() {
+	defer f.close()
+	s, info, target := f.s, f.info, f.target
+	limiter, err := s.Limiter.Open(info.Identity)
+	if err != nil {
+		logrus.Warningf("Drop datagrams from %s to %s via %s: %v", f.key.Src, target.Dest, info.Addr, err)
+		metricStreamsFailed.With("limit").Inc()
+		return
+	}
+	stream, err := info.Session.OpenStream()
+	if err == nil {
+		if err = common.WriteUDPHeader(stream, target.Host, target.Port); err != nil {
+			stream.Close()
+		}
+	}
+	if err != nil {
+		logrus.Warningf("Drop datagrams from %s to %s via %s: %v", f.key.Src, target.Dest, info.Addr, err)
+		limiter.Close()
+		metricStreamsFailed.With("open").Inc()
+		return
+	}
+	metricStreamsOpened.With(info.Identity).Inc()
+	untrack := _manager.TrackStream(info.Session, stream, target.Kind, f.key.Src, target.Dest)
+	acct := s.Accounting.Open(info.Identity, info.Addr, target.Dest)
+	dc := common.NewDatagramConn(stream, stream, s.UDP.MaxDatagramSize)
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		stream.Close()
+		untrack()
+		acct.Close()
+		limiter.Close()
+		return
+	}
+	f.stream, f.dc, f.out = stream, dc, acct.CountOut(dc)
+	f.limiter, f.acct, f.untrack = limiter, acct, untrack
+	f.mu.Unlock()
+	logrus.Debugf("UDP flow %s -> %s as %s:%d via %s", f.key.Src, target.Dest, target.Host, target.Port, info.Addr)
+
+	// 发出暂存期间新到达的数据报继续追加到 pending, 直到 pending 为空
+	for {
+		f.mu.Lock()
+		pending := f.pending
+		f.pending = nil
+		f.ready = len(pending) == 0
+		f.mu.Unlock()
+		if len(pending) == 0 {
+			break
+		}
+		for _, p := range pending {
+			f.write(p)
+		}
+	}
+
+	in := acct.CountIn(f.reply)
+	buf := make([]byte, common.MaxDatagramSize)
+	for {
+		n, err := dc.ReadDatagram(buf)
+		if errors.Is(err, common.ErrDatagramTooLarge) {
+			metricDatagramsDropped.With("too_large").Inc()
+			continue
+		}
+		if err != nil {
+			return
+		}
+		f.timer.Reset(s.udpIdleTimeout())
+		if !limiter.AllowIn(n) {
+			metricDatagramsDropped.With("rate_limit").Inc()
+			continue
+		}
+		if _, err := in.Write(buf[:n]); err != nil {
+			logrus.Debugf("UDP reply to %s failed: %v", f.key.Src, err)
+			continue
+		}
+		metricBytes.With(info.Identity, "in").Add(float64(n))
+	}
+}
+
+// close 结束 UDP 会话并释放资源; 可重复调用
+func (f *udpFlow) close() {
+	f.closeOnce.Do(func() {
+		s := f.s
+		s.udp.Lock()
+		if s.udp.flows[f.key] == f {
+			delete(s.udp.flows, f.key)
+		}
+		s.udp.Unlock()
+		f.timer.Stop()
+
+		f.mu.Lock()
+		f.closed = true
+		f.pending = nil
+		stream := f.stream
+		f.mu.Unlock()
+		if c, ok := f.reply.(io.Closer); ok {
+			c.Close()
+		}
+		if stream == nil {
+			return
+		}
+		stream.Close()
+		f.untrack()
+		f.acct.Close()
+		f.limiter.Close()
+		logrus.Debugf("UDP flow %s -> %s via %s closed", f.key.Src, f.target.Dest, f.info.Addr)
+	})
+}
+
+// closeUDPFlows 关闭全部 UDP 会话; UDP 没有连接状态, 退出时不等待
+func (s *Server) closeUDPFlows() {
+	s.udp.Lock()
+	flows := make([]*udpFlow, 0, len(s.udp.flows))
+	for _, flow := range s.udp.flows {
+		flows = append(flows, flow)
+	}
+	s.udp.Unlock()
+	for _, flow := range flows {
+		flow.close()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ares0516/tsuit/common"
+)
+
+func TestRelayDatagram(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	server, client := sessionPair(t)
+	go func() {
+		for {
+			stream, err := client.AcceptStream()
+			if err != nil {
+				return
+			}
+			go common.ServeUDPStream(stream, 0, time.Minute)
+		}
+	}()
+
+	s := &Server{
+		Limiter:    common.NewLimiter(common.Limits{}, nil),
+		Accounting: common.NewAccounting(),
+	}
+	t.Cleanup(s.closeUDPFlows)
+	info := common.SessionInfo{Addr: "10.9.2.1", Identity: "alice", Caps: common.CapUDP, Session: server}
+	addr := echo.LocalAddr().(*net.UDPAddr)
+	target := relayTarget{Kind: "udp", Dest: addr.String(), Host: addr.IP.String(), Port: uint16(addr.Port)}
+	replies := make(chan string, 8)
+	reply := replyFunc(func(p []byte) error {
+		replies <- string(p)
+		return nil
+	})
+
+	// 流打开之前到达的数据报暂存, 打开后按顺序发出
+	for _, p := range []string{"one", "two", "three"} {
+		s.relayDatagram("192.0.2.1:5353", info, target, []byte(p), reply)
+	}
+	got := map[string]bool{}
+	for range 3 {
+		select {
+		case p := <-replies:
+			got[p] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("replies %v, want one, two and three", got)
+		}
+	}
+	s.udp.Lock()
+	flows := len(s.udp.flows)
+	s.udp.Unlock()
+	if flows != 1 {
+		t.Errorf("%d flows, want 1", flows)
+	}
+
+	s.closeUDPFlows()
+	if usage := s.Accounting.Usage("alice"); len(usage) != 1 || usage[0].BytesOut != 11 || usage[0].BytesIn != 11 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
@@ -0,0 +1,82 @@
+// Package tproxy 透明代理的流量捕获, 支持两种方式:
+//
+// REDIRECT: iptables nat 表把连接重定向到普通监听, 原始目的地址通过
+// SO_ORIGINAL_DST (IPv4) / IP6T_SO_ORIGINAL_DST (IPv6) 取得, 只支持 TCP.
+//
+// TPROXY: iptables mangle 表把流量交给设置了 IP_TRANSPARENT 的监听, 连接的
+// 本地地址即原始目的地址; UDP 通过 IP_RECVORIGDSTADDR 取得每个数据报的目的地址,
+// 回包从绑定在原始目的地址上的透明 socket 发出. 需要 CAP_NET_ADMIN 以及:
+//
+//	iptables -t mangle -A PREROUTING -p tcp -d 10.0.0.0/24 -j TPROXY --on-port 5555 --tproxy-mark 1/1
+//	iptables -t mangle -A PREROUTING -p udp -d 10.0.0.0/24 -j TPROXY --on-port 5555 --tproxy-mark 1/1
+//	ip rule add fwmark 1/1 table 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//
+// IPv6 使用 ip6tables 与 ip -6 的对应命令.
+package tproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+var ErrUnsupported = errors.New("tproxy: not supported on this platform")
+
+// Mode 捕获方式
+type Mode string
+
+const (
+	ModeRedirect Mode = "redirect"
+	ModeTProxy   Mode = "tproxy"
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case "", ModeRedirect:
+		return ModeRedirect, nil
+	case ModeTProxy:
+		return ModeTProxy, nil
+	default:
+		return "", fmt.Errorf("unknown capture mode %q", s)
+	}
+}
+
+// Listen 按捕获方式打开 TCP 监听
+func Listen(mode Mode, network, addr string) (net.Listener, error) {
+	if mode == ModeTProxy {
+		return ListenTCP(network, addr)
+	}
+	return net.Listen(network, addr)
+}
+
+// UDPConn TPROXY 捕获 UDP 的 socket, 数据报附带原始目的地址
+type UDPConn struct {
+	*net.UDPConn
+	oob []byte
+}
+
+// OriginalDst 返回按 mode 捕获的连接的原始目的地址
+func OriginalDst(mode Mode, conn net.Conn) (netip.AddrPort, error) {
+	if mode == ModeTProxy {
+		return addrPort(conn.LocalAddr())
+	}
+	return RedirectDst(conn)
+}
+
+func addrPort(addr net.Addr) (netip.AddrPort, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return unmap(a.AddrPort()), nil
+	case *net.UDPAddr:
+		return unmap(a.AddrPort()), nil
+	default:
+		return netip.AddrPort{}, fmt.Errorf("tproxy: unexpected address %v", addr)
+	}
+}
+
+// unmap 双栈 socket 上的 IPv4 地址以 ::ffff:a.b.c.d 出现, 统一还原为 IPv4
+func unmap(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
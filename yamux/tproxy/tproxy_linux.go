@@ -0,0 +1,182 @@
+//go:build linux
+
+package tproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// IP6T_SO_ORIGINAL_DST 与 SO_ORIGINAL_DST 的值相同, 但位于 SOL_IPV6
+const ip6tSoOriginalDst = 80
+
+// control 设置 IP_TRANSPARENT, UDP 额外启用 IP_RECVORIGDSTADDR
+func control(network, _ string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = setsockopts(int(fd), network)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func setsockopts(fd int, network string) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+	v6 := network == "tcp6" || network == "udp6"
+	udp := network == "udp" || network == "udp4" || network == "udp6"
+
+	if v6 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			return wrapPerm("IPV6_TRANSPARENT", err)
+		}
+	} else if err := unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+		return wrapPerm("IP_TRANSPARENT", err)
+	}
+	if !udp {
+		return nil
+	}
+	if v6 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+			return err
+		}
+		// 双栈 socket 上的 IPv4 数据报通过 IP_ORIGDSTADDR 给出目的地址, 设置失败时只影响 IPv4
+		unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+		return nil
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+}
+
+func wrapPerm(opt string, err error) error {
+	if errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("%s: %w (CAP_NET_ADMIN required)", opt, err)
+	}
+	return err
+}
+
+// ListenTCP 打开 IP_TRANSPARENT 的 TCP 监听, 接受的连接的本地地址即原始目的地址
+func ListenTCP(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: control}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// ListenUDP 打开 IP_TRANSPARENT 的 UDP socket, 用 ReadFromOrig 读取数据报
+func ListenUDP(network, addr string) (*UDPConn, error) {
+	lc := net.ListenConfig{Control: control}
+	pc, err := lc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPConn{UDPConn: pc.(*net.UDPConn)}, nil
+}
+
+// ReadFromOrig 读取一个数据报, 返回源地址与原始目的地址; 不能并发调用
+func (c *UDPConn) ReadFromOrig(b []byte) (n int, src, dst netip.AddrPort, err error) {
+	if c.oob == nil {
+		c.oob = make([]byte, unix.CmsgSpace(unix.SizeofSockaddrInet6)*2)
+	}
+	n, oobn, _, src, err := c.ReadMsgUDPAddrPort(b, c.oob)
+	if err != nil {
+		return 0, src, dst, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(c.oob[:oobn])
+	if err != nil {
+		return 0, src, dst, err
+	}
+	for i := range msgs {
+		sa, err := unix.ParseOrigDstAddr(&msgs[i])
+		if err != nil {
+			continue
+		}
+		switch sa := sa.(type) {
+		case *unix.SockaddrInet4:
+			dst = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port))
+		case *unix.SockaddrInet6:
+			dst = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(sa.Port))
+		}
+		return n, unmap(src), unmap(dst), nil
+	}
+	return 0, src, dst, errors.New("tproxy: datagram without original destination")
+}
+
+// DialUDP 打开绑定在 laddr (可为非本机地址) 上并连接到 raddr 的透明 UDP socket,
+// 用于以原始目的地址的名义把回包发给发起方
+func DialUDP(laddr, raddr netip.AddrPort) (*net.UDPConn, error) {
+	network := "udp4"
+	if laddr.Addr().Is6() {
+		network = "udp6"
+	}
+	d := net.Dialer{
+		LocalAddr: net.UDPAddrFromAddrPort(laddr),
+		Control:   control,
+	}
+	conn, err := d.Dial(network, raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// RedirectDst 返回被 iptables REDIRECT 的连接的原始目的地址
+func RedirectDst(conn net.Conn) (netip.AddrPort, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("tproxy: not a socket")
+	}
+	local, err := addrPort(conn.LocalAddr())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var dst netip.AddrPort
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Is4() {
+			var sa unix.RawSockaddrInet4
+			if serr = getsockopt(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST, unsafe.Pointer(&sa), unix.SizeofSockaddrInet4); serr == nil {
+				dst = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), ntohs(sa.Port))
+			}
+			return
+		}
+		var sa unix.RawSockaddrInet6
+		if serr = getsockopt(fd, unix.SOL_IPV6, ip6tSoOriginalDst, unsafe.Pointer(&sa), unix.SizeofSockaddrInet6); serr == nil {
+			dst = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), ntohs(sa.Port))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if serr != nil {
+		return netip.AddrPort{}, &net.OpError{Op: "getsockopt", Net: "tcp", Addr: conn.LocalAddr(), Err: serr}
+	}
+	return unmap(dst), nil
+}
+
+// getsockopt 把选项值读入 val 指向的 size 字节, x/sys/unix 没有返回 sockaddr 的封装
+func getsockopt(fd uintptr, level, opt int, val unsafe.Pointer, size uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(opt), uintptr(val), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ntohs 内核返回的端口为网络字节序
+func ntohs(p uint16) uint16 {
+	return binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, p))
+}
@@ -0,0 +1,215 @@
+//go:build linux
+
+package tproxy
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const netnsEnv = "TSUIT_TPROXY_NETNS"
+
+// inNetns 在新的用户与网络命名空间中重新运行当前测试, 返回 true 表示已在命名空间中,
+// 应继续执行测试. 命名空间中 198.51.100.0/24 与 2001:db8::/64 被路由到 lo,
+// 效果相当于 TPROXY 规则把发往这些地址的流量交给本机.
+func inNetns(t *testing.T) bool {
+	t.Helper()
+	if os.Getenv(netnsEnv) == "1" {
+		for _, args := range [][]string{
+			{"link", "set", "lo", "up"},
+			{"route", "add", "local", "198.51.100.0/24", "dev", "lo"},
+			{"-6", "route", "add", "local", "2001:db8::/64", "dev", "lo"},
+		} {
+			if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+				t.Fatalf("ip %v: %v\n%s", args, err, out)
+			}
+		}
+		return true
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip command not found")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			t.Skipf("cannot create network namespace: %v", err)
+		}
+		t.Fatalf("in network namespace: %v\n%s", err, out)
+	}
+	return false
+}
+
+func TestListenTCP(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+
+	// IP_TRANSPARENT 允许绑定非本机地址
+	nonlocal, err := ListenTCP("tcp4", "203.0.113.1:80")
+	if err != nil {
+		t.Fatalf("bind non-local address: %v", err)
+	}
+	nonlocal.Close()
+
+	ln, err := ListenTCP("tcp", "[::]:15555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, dst := range []string{"198.51.100.7:15555", "[2001:db8::7]:15555"} {
+		c, err := net.DialTimeout("tcp", dst, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := OriginalDst(ModeTProxy, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := netip.MustParseAddrPort(dst); got != want {
+			t.Errorf("original destination = %s, want %s", got, want)
+		}
+		conn.Close()
+		c.Close()
+	}
+}
+
+func TestListenUDP(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+
+	ln, err := ListenUDP("udp", "[::]:15353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, dst := range []string{"198.51.100.7:15353", "[2001:db8::7]:15353"} {
+		c, err := net.Dial("udp", dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 1500)
+		ln.SetReadDeadline(time.Now().Add(time.Second))
+		n, src, orig, err := ln.ReadFromOrig(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "ping" {
+			t.Errorf("read %q", buf[:n])
+		}
+		if want := netip.MustParseAddrPort(dst); orig != want {
+			t.Errorf("original destination = %s, want %s", orig, want)
+		}
+		if want := netip.MustParseAddrPort(c.LocalAddr().String()); src != want {
+			t.Errorf("source = %s, want %s", src, want)
+		}
+
+		// 回包以原始目的地址为源地址
+		reply, err := DialUDP(orig, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply.Write([]byte("pong"))
+		reply.Close()
+
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err = c.Read(buf); err != nil {
+			t.Fatalf("reply from %s: %v", dst, err)
+		}
+		if string(buf[:n]) != "pong" {
+			t.Errorf("reply %q", buf[:n])
+		}
+	}
+}
+
+func TestRedirectDst(t *testing.T) {
+	if os.Getenv(netnsEnv) != "1" {
+		if _, err := exec.LookPath("iptables"); err != nil {
+			t.Skip("iptables command not found")
+		}
+	}
+	if !inNetns(t) {
+		return
+	}
+	for _, args := range [][]string{
+		{"iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "198.51.100.0/24", "-j", "REDIRECT", "--to-ports", "15556"},
+		{"ip6tables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "2001:db8::/64", "-j", "REDIRECT", "--to-ports", "15556"},
+	} {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Skipf("%v: %v\n%s", args, err, out)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "[::]:15556")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, dst := range []string{"198.51.100.7:80", "[2001:db8::7]:443"} {
+		c, err := net.DialTimeout("tcp", dst, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := OriginalDst(ModeRedirect, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := netip.MustParseAddrPort(dst); got != want {
+			t.Errorf("original destination = %s, want %s", got, want)
+		}
+		conn.Close()
+		c.Close()
+	}
+}
+
+func TestRedirectDstWithoutNAT(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 未经 NAT 的连接没有原始目的地址
+	if dst, err := RedirectDst(conn); err == nil {
+		t.Errorf("original destination = %s, want error", dst)
+	}
+}
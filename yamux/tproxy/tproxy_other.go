@@ -0,0 +1,28 @@
+//go:build !linux
+
+package tproxy
+
+import (
+	"net"
+	"net/netip"
+)
+
+func ListenTCP(network, addr string) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+func ListenUDP(network, addr string) (*UDPConn, error) {
+	return nil, ErrUnsupported
+}
+
+func (c *UDPConn) ReadFromOrig(b []byte) (n int, src, dst netip.AddrPort, err error) {
+	return 0, src, dst, ErrUnsupported
+}
+
+func DialUDP(laddr, raddr netip.AddrPort) (*net.UDPConn, error) {
+	return nil, ErrUnsupported
+}
+
+func RedirectDst(conn net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, ErrUnsupported
+}